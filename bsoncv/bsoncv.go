@@ -1,12 +1,16 @@
 package bsoncv
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
-	"fmt"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"math"
 	"strconv"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -14,32 +18,323 @@ const (
 	String         = '\x02'
 	Object         = '\x03'
 	Array          = '\x04'
+	Binary         = '\x05'
+	Undefined      = '\x06' // deprecated, but still found in old data
 	ObjectId       = '\x07'
 	Boolean        = '\x08'
 	UnixTimeMillis = '\x09'
 	Null           = '\x0A'
+	Regex          = '\x0B'
+	DBPointer      = '\x0C' // deprecated, but still found in old data
+	JavaScript     = '\x0D'
+	Symbol         = '\x0E' // deprecated, written as a string
 	Int32          = '\x10'
 	Time           = '\x11'
 	Int64          = '\x12'
 	Dec128         = '\x13'
+	MaxKey         = '\x7F'
+	MinKey         = '\xFF'
 	Terminal       = '\x00'
 	False          = '\x00'
 	True           = '\x01'
 )
 
+// ToJson converts bson to relaxed json. ObjectIDs are written as hex strings,
+// dates as UTC RFC3339Nano strings and timestamps as {"t":...,"i":...} so they
+// decode into a primitive.Timestamp. Binary is written as a base64 string,
+// which encoding/json decodes into a []byte, and Decimal128s as strings so
+// no precision is lost. JavaScript is written as a string. Regexes, MinKey and
+// MaxKey have no json equivalent and are written as Extended JSON:
+// {"$regularExpression":{"pattern":...,"options":...}}, {"$minKey":1} and
+// {"$maxKey":1}. The deprecated Undefined is written as null, DBPointers as
+// {"$ref":...,"$id":{"$oid":...}} and Symbols as strings.
 func ToJson(bsonbytes []byte) []byte {
+	jsonbytes, _ := toJson(bsonbytes, JsonOptions{})
+	return jsonbytes
+}
+
+// ToExtendedJson converts bson to json, writing ObjectIDs, dates, binary and
+// Decimal128s in MongoDB Extended JSON v2 form so they can be told apart from
+// plain strings:
+// {"$oid":"..."}, {"$date":{"$numberLong":"..."}}, {"$numberDecimal":"..."},
+// {"$timestamp":{"t":...,"i":...}}, {"$binary":{"base64":"...","subType":"00"}},
+// {"$code":"..."}
+// All other types are written the same as ToJson.
+func ToExtendedJson(bsonbytes []byte) []byte {
+	jsonbytes, _ := toJson(bsonbytes, JsonOptions{Extended: true})
+	return jsonbytes
+}
+
+// ToJsonIndent converts bson to json like ToJson, but starts each element on
+// a new line indented by one copy of indent per level of nesting. The output
+// matches json.Indent with an empty prefix.
+func ToJsonIndent(bsonbytes []byte, indent string) []byte {
+	jsonbytes, _ := toJson(bsonbytes, JsonOptions{Indent: indent})
+	return jsonbytes
+}
+
+// JsonOptions control the output of ToJsonWithOptions. The zero value gives
+// the same output as ToJson.
+type JsonOptions struct {
+	// Extended writes ObjectIDs, dates, decimals and timestamps as Extended
+	// JSON, see ToExtendedJson.
+	Extended bool
+	// Indent starts each element on a new line, see ToJsonIndent.
+	Indent string
+	// FloatFormat and FloatPrecision are passed to strconv.FormatFloat for
+	// doubles. Use 'g' to write very large and very small numbers with an
+	// exponent. When FloatFormat is 0 'f' is used with the shortest precision.
+	FloatFormat    byte
+	FloatPrecision int
+	// DateFormat is the layout dates are written with, RFC3339Nano when empty.
+	DateFormat string
+	// DateLocation is the location dates are written in, UTC when nil so the
+	// output doesn't depend on the host's timezone.
+	DateLocation *time.Location
+	// DateMillis writes dates as a number of milliseconds since the unix epoch
+	// instead of a formatted string.
+	DateMillis bool
+	// ReplaceInvalidUTF8 replaces each run of invalid UTF-8 in strings and
+	// names with U+FFFD so the output is always valid json. Otherwise the bytes
+	// are copied as they are.
+	ReplaceInvalidUTF8 bool
+}
+
+func ToJsonWithOptions(bsonbytes []byte, opts JsonOptions) []byte {
+	jsonbytes, _ := toJson(bsonbytes, opts)
+	return jsonbytes
+}
+
+// ToJsonValidated checks the bson with ValidateBson before converting it, so
+// a truncated or corrupt buffer returns an error instead of panicking. The
+// other conversions stop at an unsupported type without an error.
+func ToJsonValidated(bsonbytes []byte, opts JsonOptions) ([]byte, error) {
+	if err := ValidateBson(bsonbytes); err != nil {
+		return nil, err
+	}
+	return toJson(bsonbytes, opts)
+}
+
+// fixedSizes are the value lengths of the element types that don't carry their
+// own length
+var fixedSizes = map[byte]int{
+	Float64:        8,
+	ObjectId:       12,
+	Boolean:        1,
+	UnixTimeMillis: 8,
+	Null:           0,
+	Undefined:      0,
+	Int32:          4,
+	Time:           8,
+	Int64:          8,
+	Dec128:         16,
+	MinKey:         0,
+	MaxKey:         0,
+}
+
+// ValidateBson checks that every length in the document agrees with the
+// bytes available and that every element is a type ToJson can convert.
+func ValidateBson(bsonbytes []byte) error {
+	if len(bsonbytes) < 5 {
+		return errors.Errorf("bson is %d bytes, a document is at least 5", len(bsonbytes))
+	}
+	if length := int(binary.LittleEndian.Uint32(bsonbytes)); length != len(bsonbytes) {
+		return errors.Errorf("bson document length is %d but %d bytes were given", length, len(bsonbytes))
+	}
+
+	// ends holds the index of the terminator of each open document
+	var ends [64]int
+	stackptr := 0
+	ends[stackptr] = len(bsonbytes) - 1
+	idx := 4
+	for idx < len(bsonbytes) {
+		if idx == ends[stackptr] {
+			if bsonbytes[idx] != Terminal {
+				return errors.Errorf("document ending at offset %d is not terminated", idx)
+			}
+			idx++
+			stackptr--
+			continue
+		}
+		elemType := bsonbytes[idx]
+		end := idx + 1
+		for end < ends[stackptr] && bsonbytes[end] != Terminal {
+			end++
+		}
+		if end == ends[stackptr] {
+			return errors.Errorf("element name at offset %d runs past the end of its document", idx+1)
+		}
+		idx = end + 1
+
+		switch elemType {
+		case String, Symbol, JavaScript:
+			if idx+4 > ends[stackptr] {
+				return errors.Errorf("string length at offset %d runs past the end of its document", idx)
+			}
+			length := int(binary.LittleEndian.Uint32(bsonbytes[idx : idx+4]))
+			if length < 1 || idx+4+length > ends[stackptr] {
+				return errors.Errorf("string of length %d at offset %d runs past the end of its document", length, idx)
+			}
+			if bsonbytes[idx+4+length-1] != Terminal {
+				return errors.Errorf("string at offset %d is not terminated", idx)
+			}
+			idx += 4 + length
+		case DBPointer:
+			// a namespace string followed by an ObjectID
+			if idx+4 > ends[stackptr] {
+				return errors.Errorf("DBPointer length at offset %d runs past the end of its document", idx)
+			}
+			length := int(binary.LittleEndian.Uint32(bsonbytes[idx : idx+4]))
+			if length < 1 || idx+4+length+12 > ends[stackptr] {
+				return errors.Errorf("DBPointer of length %d at offset %d runs past the end of its document", length, idx)
+			}
+			if bsonbytes[idx+4+length-1] != Terminal {
+				return errors.Errorf("DBPointer at offset %d is not terminated", idx)
+			}
+			idx += 4 + length + 12
+		case Regex:
+			// the pattern and options are both cstrings
+			for i := 0; i < 2; i++ {
+				end := idx
+				for end < ends[stackptr] && bsonbytes[end] != Terminal {
+					end++
+				}
+				if end == ends[stackptr] {
+					return errors.Errorf("regex at offset %d runs past the end of its document", idx)
+				}
+				idx = end + 1
+			}
+		case Binary:
+			// a length, a subtype byte and then the data
+			if idx+5 > ends[stackptr] {
+				return errors.Errorf("binary length at offset %d runs past the end of its document", idx)
+			}
+			length := int(binary.LittleEndian.Uint32(bsonbytes[idx : idx+4]))
+			if length < 0 || idx+5+length > ends[stackptr] {
+				return errors.Errorf("binary of length %d at offset %d runs past the end of its document", length, idx)
+			}
+			idx += 5 + length
+		case Object, Array:
+			if idx+4 > ends[stackptr] {
+				return errors.Errorf("document length at offset %d runs past the end of its document", idx)
+			}
+			length := int(binary.LittleEndian.Uint32(bsonbytes[idx : idx+4]))
+			if length < 5 || idx+length > ends[stackptr] {
+				return errors.Errorf("document of length %d at offset %d runs past the end of its document", length, idx)
+			}
+			if stackptr+1 == len(ends) {
+				return errors.Errorf("document at offset %d is nested more than %d deep", idx, len(ends)-1)
+			}
+			stackptr++
+			ends[stackptr] = idx + length - 1
+			idx += 4
+		default:
+			size, ok := fixedSizes[elemType]
+			if !ok {
+				return errors.Errorf("unsupported bson type 0x%02X at offset %d", elemType, end)
+			}
+			if idx+size > ends[stackptr] {
+				return errors.Errorf("value of type 0x%02X at offset %d runs past the end of its document", elemType, idx)
+			}
+			idx += size
+		}
+	}
+	return nil
+}
+
+const hexDigits = "0123456789abcdef"
+
+var replacementChar = []byte(string(utf8.RuneError))
+
+// appendName appends an element name, escaped like string values since keys
+// can hold any character but a null
+func appendName(jsonbytes, name []byte, opts JsonOptions) []byte {
+	jsonbytes = appendString(jsonbytes, name, opts)
+	if opts.Indent != "" {
+		return append(jsonbytes, ':', ' ')
+	}
+	return append(jsonbytes, ':')
+}
+
+// appendString appends str quoted, escaping the characters json requires
+func appendString(jsonbytes, str []byte, opts JsonOptions) []byte {
+	if opts.ReplaceInvalidUTF8 && !utf8.Valid(str) {
+		str = bytes.ToValidUTF8(str, replacementChar)
+	}
+	jsonbytes = append(jsonbytes, '"')
+	for _, c := range str {
+		switch c {
+		case '"':
+			jsonbytes = append(jsonbytes, '\\', '"')
+		case '\n':
+			jsonbytes = append(jsonbytes, '\\', 'n')
+		case '\t':
+			jsonbytes = append(jsonbytes, '\\', 't')
+		case '\\':
+			jsonbytes = append(jsonbytes, '\\', '\\')
+		case '\r':
+			jsonbytes = append(jsonbytes, '\\', 'r')
+		default:
+			if c < 0x20 {
+				// the rest of the control characters need unicode escapes
+				jsonbytes = append(jsonbytes, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			} else {
+				jsonbytes = append(jsonbytes, c)
+			}
+		}
+	}
+	return append(jsonbytes, '"')
+}
+
+func appendIndent(jsonbytes []byte, indent string, depth int) []byte {
+	jsonbytes = append(jsonbytes, '\n')
+	for i := 0; i < depth; i++ {
+		jsonbytes = append(jsonbytes, indent...)
+	}
+	return jsonbytes
+}
+
+func toJson(bsonbytes []byte, opts JsonOptions) ([]byte, error) {
 	if len(bsonbytes) == 0 {
-		return bsonbytes
+		return bsonbytes, nil
 	}
-	// from here it is assumed that the bson is valid
 	initialCap := len(bsonbytes)
 	if len(bsonbytes) > 1000000 {
 		initialCap = 1000000
 	}
-	jsonbytes := make([]byte, 0, initialCap)
+	return appendJson(make([]byte, 0, initialCap), bsonbytes, opts)
+}
+
+// AppendJson appends the json conversion of bsonbytes to dst and returns the
+// extended buffer, so a caller converting many documents can reuse one buffer:
+//
+//	buf = bsoncv.AppendJson(buf[:0], doc, bsoncv.JsonOptions{})
+func AppendJson(dst, bsonbytes []byte, opts JsonOptions) []byte {
+	if len(bsonbytes) == 0 {
+		return dst
+	}
+	dst, _ = appendJson(dst, bsonbytes, opts)
+	return dst
+}
+
+func appendJson(jsonbytes, bsonbytes []byte, opts JsonOptions) ([]byte, error) {
+	// from here it is assumed that the bson is valid, see ToJsonValidated
 	idx := 4
 	jsonbytes = append(jsonbytes, '{')
 
+	floatFormat, floatPrecision := byte('f'), -1
+	if opts.FloatFormat != 0 {
+		floatFormat, floatPrecision = opts.FloatFormat, opts.FloatPrecision
+	}
+	dateFormat := time.RFC3339Nano
+	if opts.DateFormat != "" {
+		dateFormat = opts.DateFormat
+	}
+	dateLocation := time.UTC
+	if opts.DateLocation != nil {
+		dateLocation = opts.DateLocation
+	}
+
 	// Max nesting depth is 64
 	var stack [64]byte
 	stackptr := 0
@@ -47,6 +342,14 @@ func ToJson(bsonbytes []byte) []byte {
 
 	for idx < len(bsonbytes) {
 
+		if opts.Indent != "" {
+			if bsonbytes[idx] != Terminal {
+				jsonbytes = appendIndent(jsonbytes, opts.Indent, stackptr+1)
+			} else if last := jsonbytes[len(jsonbytes)-1]; last != '{' && last != '[' {
+				jsonbytes = appendIndent(jsonbytes, opts.Indent, stackptr)
+			}
+		}
+
 		switch bsonbytes[idx] {
 		case Float64:
 			idx++
@@ -55,51 +358,28 @@ func ToJson(bsonbytes []byte) []byte {
 				end++
 			}
 			if stack[stackptr] == '}' { // we skip the element mongo information in an array
-				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, '"', ':')
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
-			jsonbytes = append(
+			jsonbytes = strconv.AppendFloat(
 				jsonbytes,
-				[]byte(strconv.FormatFloat(
-					math.Float64frombits(binary.LittleEndian.Uint64(bsonbytes[idx:idx+8])),
-					'f', -1, 64),
-				)...,
+				math.Float64frombits(binary.LittleEndian.Uint64(bsonbytes[idx:idx+8])),
+				floatFormat, floatPrecision, 64,
 			)
 			idx += 8
-		case String:
+		case String, Symbol:
 			idx++
 			end := idx
 			for bsonbytes[end] != Terminal {
 				end++
 			}
 			if stack[stackptr] == '}' { // we skip the element mongo information in an array
-				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, "\":"...)
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
 			length := int(binary.LittleEndian.Uint32(bsonbytes[idx : idx+4]))
 			idx += 4
-			jsonbytes = append(jsonbytes, '"')
-			for i := idx; i < idx+length-1; i++ {
-				switch bsonbytes[i] {
-				case '"':
-					jsonbytes = append(jsonbytes, '\\', '"')
-				case '\n':
-					jsonbytes = append(jsonbytes, '\\', 'n')
-				case '\t':
-					jsonbytes = append(jsonbytes, '\\', 't')
-				case '\\':
-					jsonbytes = append(jsonbytes, '\\', '\\')
-				case '\r':
-					jsonbytes = append(jsonbytes, '\\', 'r')
-				default:
-					jsonbytes = append(jsonbytes, bsonbytes[i])
-				}
-			}
-			jsonbytes = append(jsonbytes, '"')
+			jsonbytes = appendString(jsonbytes, bsonbytes[idx:idx+length-1], opts)
 			idx += length
 		case Object:
 			idx++
@@ -108,9 +388,7 @@ func ToJson(bsonbytes []byte) []byte {
 				end++
 			}
 			if stack[stackptr] == '}' { // we skip the element mongo information in an array
-				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, "\":"...)
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
 			jsonbytes = append(jsonbytes, '{')
@@ -124,9 +402,7 @@ func ToJson(bsonbytes []byte) []byte {
 				end++
 			}
 			if stack[stackptr] == '}' { // we skip the element mongo information in an array
-				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, "\":"...)
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
 			jsonbytes = append(jsonbytes, '[')
@@ -134,22 +410,120 @@ func ToJson(bsonbytes []byte) []byte {
 			stack[stackptr] = ']'
 
 			idx += 4 // this is an iterative solution so we can throw away the length
-		case ObjectId:
+		case Regex:
+			idx++
+			end := idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
+			}
+			idx = end + 1
+			end = idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			jsonbytes = append(jsonbytes, `{"$regularExpression":{"pattern":`...)
+			jsonbytes = appendString(jsonbytes, bsonbytes[idx:end], opts)
+			idx = end + 1
+			end = idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			jsonbytes = append(jsonbytes, `,"options":`...)
+			jsonbytes = appendString(jsonbytes, bsonbytes[idx:end], opts)
+			jsonbytes = append(jsonbytes, `}}`...)
+			idx = end + 1
+		case JavaScript:
 			idx++
 			end := idx
 			for bsonbytes[end] != Terminal {
 				end++
 			}
 			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
+			}
+			idx = end + 1
+			length := int(binary.LittleEndian.Uint32(bsonbytes[idx : idx+4]))
+			idx += 4
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, `{"$code":`...)
+			}
+			jsonbytes = appendString(jsonbytes, bsonbytes[idx:idx+length-1], opts)
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, '}')
+			}
+			idx += length
+		case MinKey, MaxKey:
+			key := `{"$minKey":1}`
+			if bsonbytes[idx] == MaxKey {
+				key = `{"$maxKey":1}`
+			}
+			idx++
+			end := idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
+			}
+			idx = end + 1
+			jsonbytes = append(jsonbytes, key...)
+		case Binary:
+			idx++
+			end := idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
+			}
+			idx = end + 1
+			length := int(binary.LittleEndian.Uint32(bsonbytes[idx : idx+4]))
+			subtype := bsonbytes[idx+4]
+			idx += 5
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, `{"$binary":{"base64":"`...)
+			} else {
+				jsonbytes = append(jsonbytes, '"')
+			}
+			data := bsonbytes[idx : idx+length]
+			if subtype == 0x02 && length >= 4 {
+				// the old binary subtype repeats the length inside the data
+				data = data[4:]
+			}
+			n := len(jsonbytes)
+			jsonbytes = append(jsonbytes, make([]byte, base64.StdEncoding.EncodedLen(len(data)))...)
+			base64.StdEncoding.Encode(jsonbytes[n:], data)
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, `","subType":"`...)
+				jsonbytes = append(jsonbytes, hexDigits[subtype>>4], hexDigits[subtype&0xF])
+				jsonbytes = append(jsonbytes, `"}}`...)
+			} else {
 				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, "\":"...)
+			}
+			idx += length
+		case ObjectId:
+			idx++
+			end := idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
 			id := hex.EncodeToString(bsonbytes[idx : idx+12])
-			jsonbytes = append(jsonbytes, '"')
-			jsonbytes = append(jsonbytes, id...)
-			jsonbytes = append(jsonbytes, '"')
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, `{"$oid":"`...)
+				jsonbytes = append(jsonbytes, id...)
+				jsonbytes = append(jsonbytes, `"}`...)
+			} else {
+				jsonbytes = append(jsonbytes, '"')
+				jsonbytes = append(jsonbytes, id...)
+				jsonbytes = append(jsonbytes, '"')
+			}
 			idx += 12
 		case Boolean:
 			idx++
@@ -158,9 +532,7 @@ func ToJson(bsonbytes []byte) []byte {
 				end++
 			}
 			if stack[stackptr] == '}' { // we skip the element mongo information in an array
-				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, "\":"...)
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
 			if bsonbytes[idx] == True {
@@ -175,14 +547,22 @@ func ToJson(bsonbytes []byte) []byte {
 			for bsonbytes[end] != Terminal {
 				end++
 			}
-			if stack[stackptr] == '}' { // we skip the element id information in an array
-				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, "\":"...)
+			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
-			timestr := `"` + time.Unix(0, int64(binary.LittleEndian.Uint64(bsonbytes[idx:idx+8]))*1000000).Format(time.RFC3339Nano) + `"`
-			jsonbytes = append(jsonbytes, timestr...)
+			millis := int64(binary.LittleEndian.Uint64(bsonbytes[idx : idx+8]))
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, `{"$date":{"$numberLong":"`...)
+				jsonbytes = strconv.AppendInt(jsonbytes, millis, 10)
+				jsonbytes = append(jsonbytes, `"}}`...)
+			} else if opts.DateMillis {
+				jsonbytes = strconv.AppendInt(jsonbytes, millis, 10)
+			} else {
+				jsonbytes = append(jsonbytes, '"')
+				jsonbytes = time.Unix(0, millis*1000000).In(dateLocation).AppendFormat(jsonbytes, dateFormat)
+				jsonbytes = append(jsonbytes, '"')
+			}
 			idx += 8
 		case Null:
 			idx++
@@ -191,12 +571,42 @@ func ToJson(bsonbytes []byte) []byte {
 				end++
 			}
 			if stack[stackptr] == '}' { // we skip the element mongo information in an array
-				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, "\":"...)
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
+			}
+			idx = end + 1
+			jsonbytes = append(jsonbytes, "null"...)
+		case Undefined:
+			idx++
+			end := idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
+			// there's nothing closer to undefined in json
 			jsonbytes = append(jsonbytes, "null"...)
+		case DBPointer:
+			idx++
+			end := idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
+			}
+			idx = end + 1
+			// written as the DBRef that replaced it
+			length := int(binary.LittleEndian.Uint32(bsonbytes[idx : idx+4]))
+			idx += 4
+			jsonbytes = append(jsonbytes, `{"$ref":`...)
+			jsonbytes = appendString(jsonbytes, bsonbytes[idx:idx+length-1], opts)
+			idx += length
+			jsonbytes = append(jsonbytes, `,"$id":{"$oid":"`...)
+			jsonbytes = append(jsonbytes, hex.EncodeToString(bsonbytes[idx:idx+12])...)
+			jsonbytes = append(jsonbytes, `"}}`...)
+			idx += 12
 		case Int32:
 			idx++
 			end := idx
@@ -204,18 +614,34 @@ func ToJson(bsonbytes []byte) []byte {
 				end++
 			}
 			if stack[stackptr] == '}' { // we skip the element mongo information in an array
-				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, "\":"...)
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
-			jsonbytes = append(
-				jsonbytes,
-				[]byte(strconv.FormatUint(uint64(binary.LittleEndian.Uint32(bsonbytes[idx:idx+4])),
-					10))...)
+			jsonbytes = strconv.AppendInt(jsonbytes, int64(int32(binary.LittleEndian.Uint32(bsonbytes[idx:idx+4]))), 10)
 			idx += 4
 		case Time:
-			panic(jsonbytes)
+			idx++
+			end := idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
+			}
+			idx = end + 1
+			// the increment is the low 4 bytes, the seconds the high 4
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, `{"$timestamp":`...)
+			}
+			jsonbytes = append(jsonbytes, `{"t":`...)
+			jsonbytes = strconv.AppendUint(jsonbytes, uint64(binary.LittleEndian.Uint32(bsonbytes[idx+4:idx+8])), 10)
+			jsonbytes = append(jsonbytes, `,"i":`...)
+			jsonbytes = strconv.AppendUint(jsonbytes, uint64(binary.LittleEndian.Uint32(bsonbytes[idx:idx+4])), 10)
+			jsonbytes = append(jsonbytes, '}')
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, '}')
+			}
+			idx += 8
 		case Int64:
 			idx++
 			end := idx
@@ -223,27 +649,49 @@ func ToJson(bsonbytes []byte) []byte {
 				end++
 			}
 			if stack[stackptr] == '}' { // we skip the element mongo information in an array
-				jsonbytes = append(jsonbytes, '"')
-				jsonbytes = append(jsonbytes, bsonbytes[idx:end]...)
-				jsonbytes = append(jsonbytes, "\":"...)
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
 			}
 			idx = end + 1
-			jsonbytes = append(
-				jsonbytes,
-				[]byte(strconv.FormatUint(binary.LittleEndian.Uint64(bsonbytes[idx:idx+8]), 10))...)
+			jsonbytes = strconv.AppendInt(jsonbytes, int64(binary.LittleEndian.Uint64(bsonbytes[idx:idx+8])), 10)
 			idx += 8
 		case Dec128:
-			panic(jsonbytes)
+			idx++
+			end := idx
+			for bsonbytes[end] != Terminal {
+				end++
+			}
+			if stack[stackptr] == '}' { // we skip the element mongo information in an array
+				jsonbytes = appendName(jsonbytes, bsonbytes[idx:end], opts)
+			}
+			idx = end + 1
+			dec := primitive.NewDecimal128(
+				binary.LittleEndian.Uint64(bsonbytes[idx+8:idx+16]),
+				binary.LittleEndian.Uint64(bsonbytes[idx:idx+8]),
+			)
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, `{"$numberDecimal":"`...)
+			} else {
+				jsonbytes = append(jsonbytes, '"')
+			}
+			jsonbytes = append(jsonbytes, dec.String()...)
+			if opts.Extended {
+				jsonbytes = append(jsonbytes, `"}`...)
+			} else {
+				jsonbytes = append(jsonbytes, '"')
+			}
+			idx += 16
 		case Terminal:
 			idx++
 			jsonbytes = append(jsonbytes, stack[stackptr])
 			stack[stackptr] = Terminal
 			stackptr--
 		default:
-			fmt.Println(bsonbytes[idx])
-			return jsonbytes
+			return jsonbytes, errors.Errorf("unsupported bson type 0x%02X at offset %d", bsonbytes[idx], idx)
 		}
-		// Add commas in the right spots
+		// Add commas in the right spots. Every element, including a closed
+		// document or array, is followed by a comma unless the next byte ends
+		// its parent. The first element of a document or array is the only one
+		// written straight after a '{' or '['.
 		if idx < len(bsonbytes) &&
 			bsonbytes[idx] != Terminal &&
 			jsonbytes[len(jsonbytes)-1] != '{' &&
@@ -251,6 +699,5 @@ func ToJson(bsonbytes []byte) []byte {
 			jsonbytes = append(jsonbytes, ',')
 		}
 	}
-	return jsonbytes
+	return jsonbytes, nil
 }
-
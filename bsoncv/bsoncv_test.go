@@ -0,0 +1,506 @@
+package bsoncv_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/dustinevan/mongo/bsoncv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"testing"
+	"time"
+)
+
+type jsonCase struct {
+	caseNum  int
+	name     string
+	doc      interface{}
+	expected string
+}
+
+func marshal(t *testing.T, doc interface{}) []byte {
+	t.Helper()
+	bsn, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return bsn
+}
+
+func TestToExtendedJson(t *testing.T) {
+	dec, err := primitive.ParseDecimal128("123.45")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []jsonCase{
+		{
+			caseNum:  1,
+			name:     "It writes ObjectIDs as $oid",
+			doc:      bson.D{{Key: "_id", Value: objectId}},
+			expected: `{"_id":{"$oid":"0123456789abcdef01234567"}}`,
+		},
+		{
+			caseNum:  2,
+			name:     "It writes dates as $date millis",
+			doc:      bson.D{{Key: "date", Value: time.Unix(1578915133, 222000000)}},
+			expected: `{"date":{"$date":{"$numberLong":"1578915133222"}}}`,
+		},
+		{
+			caseNum:  3,
+			name:     "It writes Decimal128s as $numberDecimal",
+			doc:      bson.D{{Key: "price", Value: dec}},
+			expected: `{"price":{"$numberDecimal":"123.45"}}`,
+		},
+		{
+			caseNum: 4,
+			name:    "It writes extended values inside arrays and leaves other types alone",
+			doc: bson.D{
+				{Key: "ids", Value: bson.A{objectId, objectId}},
+				{Key: "name", Value: "name"},
+			},
+			expected: `{"ids":[{"$oid":"0123456789abcdef01234567"},{"$oid":"0123456789abcdef01234567"}],"name":"name"}`,
+		},
+	}
+	for _, c := range cases {
+		actual := string(bsoncv.ToExtendedJson(marshal(t, c.doc)))
+		if actual != c.expected {
+			t.Errorf("FAILED: caseNum:%v - %s\nexpected: %s\nactual:   %s\n", c.caseNum, c.name, c.expected, actual)
+		}
+	}
+
+	// the relaxed form is still the default
+	relaxed := string(bsoncv.ToJson(marshal(t, bson.D{{Key: "_id", Value: objectId}})))
+	if relaxed != `{"_id":"0123456789abcdef01234567"}` {
+		t.Errorf("expected relaxed ObjectID output, got %s", relaxed)
+	}
+}
+
+func TestToJsonIndent(t *testing.T) {
+	fixtures := []interface{}{
+		bson.D{},
+		bson.D{{Key: "_id", Value: objectId}, {Key: "name", Value: "name"}},
+		bson.D{
+			{Key: "empty", Value: bson.D{}},
+			{Key: "emptyArray", Value: bson.A{}},
+			{Key: "nested", Value: bson.D{
+				{Key: "array", Value: bson.A{int32(1), "two", bson.D{{Key: "three", Value: 3.5}}}},
+				{Key: "ok", Value: true},
+			}},
+			{Key: "null", Value: nil},
+		},
+		bson.A{bson.A{int32(1), int32(2)}, bson.D{{Key: "a", Value: bson.A{}}}},
+	}
+	for i, f := range fixtures {
+		var doc interface{} = f
+		if a, ok := f.(bson.A); ok {
+			doc = bson.D{{Key: "array", Value: a}}
+		}
+		bsn := marshal(t, doc)
+		var expected bytes.Buffer
+		if err := json.Indent(&expected, bsoncv.ToJson(bsn), "", "\t"); err != nil {
+			t.Fatalf("fixture %d: %v", i, err)
+		}
+		actual := bsoncv.ToJsonIndent(bsn, "\t")
+		if string(actual) != expected.String() {
+			t.Errorf("FAILED: fixture %d\nexpected: %s\nactual:   %s\n", i, expected.String(), actual)
+		}
+	}
+}
+
+func TestToJsonChangeEvent(t *testing.T) {
+	event := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "_data", Value: "8263"}}},
+		{Key: "operationType", Value: "insert"},
+		{Key: "clusterTime", Value: primitive.Timestamp{T: 1578915133, I: 2}},
+		{Key: "fullDocument", Value: bson.D{{Key: "_id", Value: objectId}, {Key: "name", Value: "name"}}},
+		{Key: "ns", Value: bson.D{{Key: "db", Value: "app"}, {Key: "coll", Value: "users"}}},
+	}
+	expected := `{"_id":{"_data":"8263"},"operationType":"insert","clusterTime":{"t":1578915133,"i":2},` +
+		`"fullDocument":{"_id":"0123456789abcdef01234567","name":"name"},"ns":{"db":"app","coll":"users"}}`
+	actual := string(bsoncv.ToJson(marshal(t, event)))
+	if actual != expected {
+		t.Errorf("expected: %s\nactual:   %s", expected, actual)
+	}
+
+	var decoded struct {
+		ClusterTime  primitive.Timestamp `json:"clusterTime"`
+		FullDocument struct {
+			ID string `json:"_id"`
+		} `json:"fullDocument"`
+	}
+	if err := json.Unmarshal([]byte(actual), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ClusterTime != (primitive.Timestamp{T: 1578915133, I: 2}) || decoded.FullDocument.ID != objectId.Hex() {
+		t.Errorf("unexpected decoded event %+v", decoded)
+	}
+
+	extended := string(bsoncv.ToExtendedJson(marshal(t, bson.D{{Key: "ts", Value: primitive.Timestamp{T: 1, I: 2}}})))
+	if extended != `{"ts":{"$timestamp":{"t":1,"i":2}}}` {
+		t.Errorf("unexpected extended timestamp %s", extended)
+	}
+}
+
+func TestToJsonFloatFormat(t *testing.T) {
+	bsn := marshal(t, bson.D{{Key: "big", Value: 1e20}, {Key: "small", Value: 1e-10}, {Key: "pi", Value: 3.14159}})
+	cases := []struct {
+		opts     bsoncv.JsonOptions
+		expected string
+	}{
+		{bsoncv.JsonOptions{}, `{"big":100000000000000000000,"small":0.0000000001,"pi":3.14159}`},
+		{bsoncv.JsonOptions{FloatFormat: 'g', FloatPrecision: -1}, `{"big":1e+20,"small":1e-10,"pi":3.14159}`},
+		{bsoncv.JsonOptions{FloatFormat: 'e', FloatPrecision: 2}, `{"big":1.00e+20,"small":1.00e-10,"pi":3.14e+00}`},
+	}
+	for _, c := range cases {
+		actual := string(bsoncv.ToJsonWithOptions(bsn, c.opts))
+		if actual != c.expected {
+			t.Errorf("%+v\nexpected: %s\nactual:   %s", c.opts, c.expected, actual)
+		}
+		var decoded map[string]float64
+		if err := json.Unmarshal([]byte(actual), &decoded); err != nil {
+			t.Errorf("%+v produced invalid json: %v", c.opts, err)
+		}
+	}
+}
+
+func TestToJsonArrays(t *testing.T) {
+	date1 := time.Unix(1578915133, 222000000)
+	date2 := time.Unix(1578915134, 0)
+	cases := []jsonCase{
+		{
+			caseNum:  1,
+			name:     "It skips the index names of ObjectIDs in arrays",
+			doc:      bson.D{{Key: "ids", Value: bson.A{objectId, objectId}}},
+			expected: `{"ids":["0123456789abcdef01234567","0123456789abcdef01234567"]}`,
+		},
+		{
+			caseNum:  2,
+			name:     "It skips the index names of dates in arrays",
+			doc:      bson.D{{Key: "dates", Value: bson.A{date1, date2}}},
+			expected: `{"dates":["2020-01-13T11:32:13.222Z","2020-01-13T11:32:14Z"]}`,
+		},
+		{
+			caseNum: 3,
+			name:    "It skips the index names of every type in arrays",
+			doc: bson.D{{Key: "mixed", Value: bson.A{
+				1.5, "two", bson.D{{Key: "three", Value: int32(3)}}, bson.A{int32(4)}, true, nil,
+				int32(5), primitive.Timestamp{T: 6, I: 7}, int64(8),
+			}}},
+			expected: `{"mixed":[1.5,"two",{"three":3},[4],true,null,5,{"t":6,"i":7},8]}`,
+		},
+		{
+			caseNum:  4,
+			name:     "It writes negative ints and escapes control characters",
+			doc:      bson.D{{Key: "ints", Value: bson.A{int32(-5), int64(-8)}}, {Key: "str", Value: "a\x01b\x1f"}},
+			expected: `{"ints":[-5,-8],"str":"a\u0001b\u001f"}`,
+		},
+	}
+	for _, c := range cases {
+		actual := string(bsoncv.ToJson(marshal(t, c.doc)))
+		if actual != c.expected {
+			t.Errorf("FAILED: caseNum:%v - %s\nexpected: %s\nactual:   %s\n", c.caseNum, c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestToJsonValidated(t *testing.T) {
+	bsn := marshal(t, bson.D{
+		{Key: "_id", Value: objectId},
+		{Key: "name", Value: "name"},
+		{Key: "nested", Value: bson.D{{Key: "n", Value: int32(1)}}},
+	})
+	actual, err := bsoncv.ToJsonValidated(bsn, bsoncv.JsonOptions{})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if string(actual) != string(bsoncv.ToJson(bsn)) {
+		t.Errorf("expected the same output as ToJson, got %s", actual)
+	}
+
+	for i := 0; i < len(bsn); i++ {
+		if _, err := bsoncv.ToJsonValidated(bsn[:i], bsoncv.JsonOptions{}); err == nil {
+			t.Errorf("expected an error for bson truncated to %d bytes", i)
+		}
+	}
+
+	// a truncated buffer with its length rewritten to match
+	short := append([]byte{}, bsn[:len(bsn)-6]...)
+	binary.LittleEndian.PutUint32(short, uint32(len(short)))
+	if err := bsoncv.ValidateBson(short); err == nil {
+		t.Error("expected an error for a buffer with a rewritten length")
+	}
+
+	dec, err := primitive.ParseDecimal128("1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decbsn := marshal(t, bson.D{{Key: "price", Value: dec}})
+	if actual, err := bsoncv.ToJsonValidated(decbsn, bsoncv.JsonOptions{}); err != nil || string(actual) != `{"price":"1.5"}` {
+		t.Errorf("expected a Decimal128 to be written as a string, got %s %+v", actual, err)
+	}
+	if _, err := bsoncv.ToJsonValidated(decbsn, bsoncv.JsonOptions{Extended: true}); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	// an element of type 0x7E, which isn't a bson type
+	unsupported := []byte{0, 0, 0, 0, 0x7E, 'a', 0, 0}
+	binary.LittleEndian.PutUint32(unsupported, uint32(len(unsupported)))
+	if _, err := bsoncv.ToJsonValidated(unsupported, bsoncv.JsonOptions{}); err == nil || !strings.Contains(err.Error(), "unsupported bson type 0x7E") {
+		t.Errorf("expected an unsupported type error, got %v", err)
+	}
+	if actual := bsoncv.ToJson(unsupported); string(actual) != "{" {
+		t.Errorf("expected the conversion to stop at the unsupported type, got %s", actual)
+	}
+}
+
+func TestToJsonEmpty(t *testing.T) {
+	cases := []jsonCase{
+		{
+			caseNum:  1,
+			name:     "It writes an empty document as {}",
+			doc:      bson.D{},
+			expected: `{}`,
+		},
+		{
+			caseNum:  2,
+			name:     "It writes an empty subdocument without a stray comma",
+			doc:      bson.D{{Key: "empty", Value: bson.D{}}},
+			expected: `{"empty":{}}`,
+		},
+		{
+			caseNum:  3,
+			name:     "It writes an empty array without a stray comma",
+			doc:      bson.D{{Key: "empty", Value: bson.A{}}},
+			expected: `{"empty":[]}`,
+		},
+		{
+			caseNum: 4,
+			name:    "It separates empty values from their neighbors",
+			doc: bson.D{
+				{Key: "a", Value: bson.D{}},
+				{Key: "b", Value: bson.A{}},
+				{Key: "c", Value: bson.A{bson.D{}, bson.A{}, bson.D{}}},
+				{Key: "d", Value: bson.D{{Key: "e", Value: bson.D{}}}},
+				{Key: "f", Value: int32(1)},
+			},
+			expected: `{"a":{},"b":[],"c":[{},[],{}],"d":{"e":{}},"f":1}`,
+		},
+	}
+	for _, c := range cases {
+		bsn := marshal(t, c.doc)
+		actual, err := bsoncv.ToJsonValidated(bsn, bsoncv.JsonOptions{})
+		if err != nil {
+			t.Errorf("FAILED: caseNum:%v - %s\n%+v", c.caseNum, c.name, err)
+		}
+		if string(actual) != c.expected {
+			t.Errorf("FAILED: caseNum:%v - %s\nexpected: %s\nactual:   %s\n", c.caseNum, c.name, c.expected, actual)
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(actual, &decoded); err != nil {
+			t.Errorf("FAILED: caseNum:%v - %s produced invalid json: %v", c.caseNum, c.name, err)
+		}
+	}
+}
+
+func TestAppendJson(t *testing.T) {
+	first := marshal(t, bson.D{{Key: "name", Value: "a much longer first name"}})
+	second := marshal(t, bson.D{{Key: "name", Value: "short"}})
+
+	buf := bsoncv.AppendJson(nil, first, bsoncv.JsonOptions{})
+	if string(buf) != string(bsoncv.ToJson(first)) {
+		t.Errorf("unexpected json %s", buf)
+	}
+	reused := bsoncv.AppendJson(buf[:0], second, bsoncv.JsonOptions{})
+	if string(reused) != `{"name":"short"}` || &reused[0] != &buf[0] {
+		t.Errorf("expected the buffer to be reused, got %s", reused)
+	}
+	if prefixed := bsoncv.AppendJson([]byte("docs="), second, bsoncv.JsonOptions{}); string(prefixed) != `docs={"name":"short"}` {
+		t.Errorf("unexpected json %s", prefixed)
+	}
+}
+
+func TestToJsonDateFormat(t *testing.T) {
+	date := time.Unix(1578915133, 222000000)
+	bsn := marshal(t, bson.D{{Key: "date", Value: date}, {Key: "dates", Value: bson.A{date}}})
+	cases := []struct {
+		opts     bsoncv.JsonOptions
+		expected string
+	}{
+		{bsoncv.JsonOptions{}, `{"date":"2020-01-13T11:32:13.222Z","dates":["2020-01-13T11:32:13.222Z"]}`},
+		{bsoncv.JsonOptions{DateMillis: true}, `{"date":1578915133222,"dates":[1578915133222]}`},
+		{bsoncv.JsonOptions{DateFormat: "2006-01-02 15:04"}, `{"date":"2020-01-13 11:32","dates":["2020-01-13 11:32"]}`},
+		{bsoncv.JsonOptions{DateMillis: true, Extended: true}, `{"date":{"$date":{"$numberLong":"1578915133222"}},"dates":[{"$date":{"$numberLong":"1578915133222"}}]}`},
+	}
+	for _, c := range cases {
+		actual := string(bsoncv.ToJsonWithOptions(bsn, c.opts))
+		if actual != c.expected {
+			t.Errorf("%+v\nexpected: %s\nactual:   %s", c.opts, c.expected, actual)
+		}
+	}
+}
+
+func TestToJsonDateLocation(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC-7", -7*60*60)
+	defer func() { time.Local = local }()
+
+	bsn := marshal(t, bson.D{{Key: "date", Value: time.Unix(1578915133, 222000000)}})
+	if actual := string(bsoncv.ToJson(bsn)); actual != `{"date":"2020-01-13T11:32:13.222Z"}` {
+		t.Errorf("expected UTC output, got %s", actual)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	actual := string(bsoncv.ToJsonWithOptions(bsn, bsoncv.JsonOptions{DateLocation: newYork}))
+	if actual != `{"date":"2020-01-13T06:32:13.222-05:00"}` {
+		t.Errorf("expected New York output, got %s", actual)
+	}
+}
+
+func TestToJsonNestedArrays(t *testing.T) {
+	cases := []jsonCase{
+		{
+			caseNum: 1,
+			name:    "It separates documents holding arrays",
+			doc: bson.D{{Key: "docs", Value: bson.A{
+				bson.D{{Key: "a", Value: bson.A{int32(1), int32(2)}}},
+				bson.D{{Key: "b", Value: bson.A{int32(3)}}},
+			}}},
+			expected: `{"docs":[{"a":[1,2]},{"b":[3]}]}`,
+		},
+		{
+			caseNum: 2,
+			name:    "It separates arrays of documents holding arrays of documents",
+			doc: bson.D{
+				{Key: "docs", Value: bson.A{
+					bson.A{bson.D{{Key: "a", Value: bson.A{bson.D{{Key: "b", Value: bson.A{}}}, bson.D{}}}}},
+					bson.D{{Key: "c", Value: bson.A{bson.A{int32(1)}, bson.A{int32(2)}}}, {Key: "d", Value: int32(4)}},
+					int32(5),
+				}},
+				{Key: "after", Value: true},
+			},
+			expected: `{"docs":[[{"a":[{"b":[]},{}]}],{"c":[[1],[2]],"d":4},5],"after":true}`,
+		},
+	}
+	for _, c := range cases {
+		bsn := marshal(t, c.doc)
+		actual := string(bsoncv.ToJson(bsn))
+		if actual != c.expected {
+			t.Errorf("FAILED: caseNum:%v - %s\nexpected: %s\nactual:   %s\n", c.caseNum, c.name, c.expected, actual)
+		}
+		var expected bytes.Buffer
+		if err := json.Indent(&expected, []byte(c.expected), "", "  "); err != nil {
+			t.Fatalf("caseNum:%v: %v", c.caseNum, err)
+		}
+		if indented := string(bsoncv.ToJsonIndent(bsn, "  ")); indented != expected.String() {
+			t.Errorf("FAILED: caseNum:%v - %s indented\nexpected: %s\nactual:   %s\n", c.caseNum, c.name, expected.String(), indented)
+		}
+	}
+}
+
+func TestToJsonDeprecatedTypes(t *testing.T) {
+	cases := []jsonCase{
+		{
+			caseNum:  1,
+			name:     "It writes Undefined as null",
+			doc:      bson.D{{Key: "u", Value: primitive.Undefined{}}, {Key: "a", Value: bson.A{primitive.Undefined{}, int32(1)}}},
+			expected: `{"u":null,"a":[null,1]}`,
+		},
+		{
+			caseNum: 2,
+			name:    "It writes DBPointers as DBRefs",
+			doc: bson.D{
+				{Key: "owner", Value: primitive.DBPointer{DB: "db.users", Pointer: objectId}},
+				{Key: "refs", Value: bson.A{primitive.DBPointer{DB: "db.\"odd\"", Pointer: objectId}}},
+			},
+			expected: `{"owner":{"$ref":"db.users","$id":{"$oid":"0123456789abcdef01234567"}},` +
+				`"refs":[{"$ref":"db.\"odd\"","$id":{"$oid":"0123456789abcdef01234567"}}]}`,
+		},
+		{
+			caseNum:  3,
+			name:     "It writes Symbols as strings",
+			doc:      bson.D{{Key: "sym", Value: primitive.Symbol("ruby\tsym")}, {Key: "syms", Value: bson.A{primitive.Symbol("a"), "b"}}},
+			expected: `{"sym":"ruby\tsym","syms":["a","b"]}`,
+		},
+	}
+	for _, c := range cases {
+		bsn := marshal(t, c.doc)
+		actual, err := bsoncv.ToJsonValidated(bsn, bsoncv.JsonOptions{})
+		if err != nil {
+			t.Fatalf("FAILED: caseNum:%v - %+v", c.caseNum, err)
+		}
+		if string(actual) != c.expected {
+			t.Errorf("FAILED: caseNum:%v - %s\nexpected: %s\nactual:   %s\n", c.caseNum, c.name, c.expected, actual)
+		}
+		if !json.Valid(actual) {
+			t.Errorf("FAILED: caseNum:%v - invalid json %s", c.caseNum, actual)
+		}
+	}
+}
+
+func TestToJsonRegexCodeAndKeys(t *testing.T) {
+	bsn := marshal(t, bson.D{
+		{Key: "re", Value: primitive.Regex{Pattern: `^a"b\d`, Options: "xi"}},
+		{Key: "code", Value: primitive.JavaScript("function() { return 1 }")},
+		{Key: "bounds", Value: bson.A{primitive.MinKey{}, primitive.MaxKey{}}},
+	})
+	if err := bsoncv.ValidateBson(bsn); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	relaxed := `{"re":{"$regularExpression":{"pattern":"^a\"b\\d","options":"ix"}},` +
+		`"code":"function() { return 1 }","bounds":[{"$minKey":1},{"$maxKey":1}]}`
+	if actual := string(bsoncv.ToJson(bsn)); actual != relaxed {
+		t.Errorf("expected: %s\nactual:   %s", relaxed, actual)
+	}
+	extended := `{"re":{"$regularExpression":{"pattern":"^a\"b\\d","options":"ix"}},` +
+		`"code":{"$code":"function() { return 1 }"},"bounds":[{"$minKey":1},{"$maxKey":1}]}`
+	if actual := string(bsoncv.ToExtendedJson(bsn)); actual != extended {
+		t.Errorf("expected: %s\nactual:   %s", extended, actual)
+	}
+	var raw bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(extended), true, &raw); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(raw, bsn) {
+		t.Error("extended json didn't read back to the same bson")
+	}
+}
+
+func TestToJsonEscapesNames(t *testing.T) {
+	bsn := marshal(t, bson.D{
+		{Key: `say "hi"`, Value: int32(1)},
+		{Key: "back\\slash", Value: bson.D{{Key: "tab\there", Value: "x"}}},
+	})
+	actual := bsoncv.ToJson(bsn)
+	expected := `{"say \"hi\"":1,"back\\slash":{"tab\there":"x"}}`
+	if string(actual) != expected {
+		t.Errorf("expected: %s\nactual:   %s", expected, actual)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(actual, &decoded); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if decoded[`say "hi"`] != float64(1) {
+		t.Errorf("expected the quoted key to round trip, got %v", decoded)
+	}
+}
+
+func TestToJsonInvalidUTF8(t *testing.T) {
+	bsn := marshal(t, bson.D{{Key: "bad\xfe", Value: "a\xffb\xc3"}, {Key: "ok", Value: "é"}})
+
+	actual := bsoncv.ToJsonWithOptions(bsn, bsoncv.JsonOptions{ReplaceInvalidUTF8: true})
+	expected := "{\"bad\uFFFD\":\"a\uFFFDb\uFFFD\",\"ok\":\"é\"}"
+	if string(actual) != expected {
+		t.Errorf("expected: %s\nactual:   %s", expected, actual)
+	}
+	if !json.Valid(actual) {
+		t.Errorf("expected valid json, got %s", actual)
+	}
+
+	// the bytes are left alone by default
+	if actual := bsoncv.ToJson(bsn); !bytes.Contains(actual, []byte("a\xffb")) {
+		t.Errorf("expected the invalid bytes to be copied, got %q", actual)
+	}
+}
@@ -1,18 +1,26 @@
 package bsoncv
 
 import (
+	"bytes"
+	"encoding/binary"
 	jsondec "encoding/json"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"math"
+	"math/big"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // bsoncv Struct Tags are formatted like this:
 // bsoncv:"fieldname,conversionType,omitempty,dateformat"
-// if an element isn't specified the commas must be present.
+// if an element isn't specified the commas must be present. keepempty in the
+// omitempty slot keeps a field when Options.OmitEmptyByDefault is set.
 // Example:
 // type User struct {
 // 	// *** Element Names ***
@@ -51,6 +59,10 @@ import (
 // 	// conversion uses the format specified in the tag
 // 	// NOTE: No commas can be used in this specified format
 // 	CustomDate string `bsoncv:"ccExpDate,$date,omitempty,01/02"`
+// 	// e_name: localDate, valueType: bsontype.DateTime
+// 	// an optional fifth element names the IANA location used to parse dates
+// 	// that don't carry a zone. time.Parse assumes UTC without it.
+// 	LocalDate string `bsoncv:"localDate,$date,,2006-01-02 15:04,America/New_York"`
 // 	// e_name: ptr, valueType: bsontype.ObjectID
 // 	// omitempty if it's nil
 //
@@ -59,10 +71,88 @@ import (
 // 	// e_name: ptr2, valueType: bsontype.ObjectID || bsontype.Null if Pointer2 == nil
 // 	Pointer2 *string `bsoncv:"ptr2,$oid"`
 //
+// 	// *** Slices of Structs ***
+// 	// e_name: items, valueType: bsontype.Array of embedded documents
+// 	// each element is converted with its own bsoncv tags, nil pointers are null
+// 	Items []LineItem `bsoncv:"items,,omitempty"`
+//
 // 	// *** Unstructured JSON ***
 // 	// e_name: raw, the data is unmarshalled to an interface{} and the bson marshaller
 // 	// works normally.
 // 	RawJson []byte `bsoncv:"raw,$jsonbytes"`
+//
+// 	// json.RawMessage and RawJSON fields don't need the $json tag
+// 	Payload json.RawMessage `bsoncv:"payload"`
+//
+// 	// *** Durations ***
+// 	// e_name: ttl, valueType: bsontype.Int64
+// 	// the fourth element is the unit, ns, us, ms, s, m or h, and defaults to
+// 	// ns. Strings are parsed with time.ParseDuration.
+// 	TTL time.Duration `bsoncv:"ttl,$duration,,ms"`
+//
+// 	// *** Binary ***
+// 	// e_name: hash, valueType: bsontype.Binary with the generic subtype
+// 	// byte slices without a conversion are stored as binary, nil ones as null
+// 	Hash []byte `bsoncv:"hash"`
+// 	// e_name: token, valueType: bsontype.Binary with the uuid subtype, errors
+// 	// unless it's 16 bytes. Other subtypes are given as numbers, e.g. 0x80.
+// 	// Arrays need $binary to be stored as binary, so primitive.ObjectID and
+// 	// other byte array types are left to the driver.
+// 	Token [16]byte `bsoncv:"token,$binary,,uuid"`
+//
+// 	// *** Custom Encoding ***
+// 	// types implementing bson.Marshaler or bson.ValueMarshaler are passed to the
+// 	// driver as is, unless the tag names a conversion
+// 	Price Money `bsoncv:"price"`
+//
+// 	// *** Integer Widths ***
+// 	// e_name: count, valueType: bsontype.Int32, errors if Count overflows an int32
+// 	Count int `bsoncv:"count,$int32"`
+// 	// e_name: total, valueType: bsontype.Int64
+// 	Total int32 `bsoncv:"total,$int64"`
+//
+// 	// *** Booleans ***
+// 	// e_name: active, valueType: bsontype.Boolean
+// 	// strings use strconv.ParseBool semantics plus yes/no, ints are true if nonzero
+// 	Active string `bsoncv:"active,$bool,omitempty"`
+//
+// 	// *** GeoJSON ***
+// 	// e_name: location, valueType: bsontype.EmbeddedDocument
+// 	// {type: "Point", coordinates: [lng, lat]} from a "lng,lat" string, errors if
+// 	// either is out of range. Structs with float Lng and Lat (or Longitude and
+// 	// Latitude) fields work too.
+// 	Location string `bsoncv:"location,$point,omitempty"`
+//
+// 	// *** Timestamps ***
+// 	// e_name: ts, valueType: bsontype.Timestamp
+// 	// ints are seconds since the epoch with an increment of 0, strings are
+// 	// RFC3339. Structs with integer T and I fields, like primitive.Timestamp,
+// 	// set both. Errors if the seconds don't fit in a uint32.
+// 	TS int64 `bsoncv:"ts,$timestamp,omitempty"`
+//
+// 	// *** Money ***
+// 	// e_name: price, valueType: bsontype.Decimal128
+// 	// an integer amount of minor units, the fourth element is the number of
+// 	// decimal places and defaults to 2, so 12345 is stored as 123.45
+// 	Price int64 `bsoncv:"price,$money,,2"`
+//
+// 	// *** Date Ranges ***
+// 	// e_name: valid, valueType: bsontype.EmbeddedDocument
+// 	// {from: <date>, to: <date>} from a [2]time.Time or a struct with time.Time
+// 	// From and To (or Start and End) fields, errors if from is after to
+// 	Valid [2]time.Time `bsoncv:"valid,$daterange,omitempty"`
+//
+// 	// *** Custom Conversions ***
+// 	// e_name: area, valueType: whatever the function registered for $geojson
+// 	// with RegisterConversion returns
+// 	Area string `bsoncv:"area,$geojson,omitempty"`
+//
+// 	// *** Extra Fields ***
+// 	// the keys of a map[string]interface{} tagged inline are written at the
+// 	// top level of the document, it's an error if one is also a field's name.
+// 	// Tag it bson:",inline" as well and the driver fills it with the keys no
+// 	// other field claims when decoding.
+// 	Extra map[string]interface{} `bson:",inline" bsoncv:",inline"`
 // }
 
 type convType int
@@ -72,6 +162,17 @@ const (
 	oid
 	date
 	json
+	int32Conv
+	int64Conv
+	boolConv
+	point
+	money
+	binaryConv
+	duration
+	daterange
+	timestamp
+	// a conversion added with RegisterConversion
+	custom
 )
 
 var convTypeNames = [...]string{
@@ -79,43 +180,164 @@ var convTypeNames = [...]string{
 	"$oid",
 	"$date",
 	"$json",
+	"$int32",
+	"$int64",
+	"$bool",
+	"$point",
+	"$money",
+	"$binary",
+	"$duration",
+	"$daterange",
+	"$timestamp",
+	// custom conversions are named in bsonConvTag.name
+	"",
 }
 
 func parseConvType(t string) convType {
 	for i, name := range convTypeNames {
-		if name == t {
+		if name == t && convType(i) != custom {
 			return convType(i)
 		}
 	}
+	conversionsMu.RLock()
+	defer conversionsMu.RUnlock()
+	if _, ok := conversions[t]; ok {
+		return custom
+	}
 	return invalid
 }
 
+// ConvTag describes the bsoncv tag of a field using a custom conversion.
+type ConvTag struct {
+	// the conversion name, e.g. $geojson
+	Name      string
+	OmitEmpty bool
+	// the tag elements after omitempty
+	Args []string
+}
+
+// ConversionFunc converts a field's value, with pointers dereferenced, to the
+// value written to the map.
+type ConversionFunc func(v reflect.Value, tag ConvTag) (interface{}, error)
+
+var (
+	conversionsMu sync.RWMutex
+	conversions   = map[string]ConversionFunc{}
+)
+
+// RegisterConversion makes fn available as a conversion in bsoncv tags under
+// name, e.g. bsoncv:"location,$geojson". Like sql.Register it's meant to be
+// called from init and panics if fn is nil or name is already taken.
+func RegisterConversion(name string, fn ConversionFunc) {
+	conversionsMu.Lock()
+	defer conversionsMu.Unlock()
+	if fn == nil {
+		panic("bsoncv: RegisterConversion fn is nil for " + name)
+	}
+	if name == "" {
+		panic("bsoncv: RegisterConversion name is empty")
+	}
+	for _, builtin := range convTypeNames {
+		if name == builtin {
+			panic("bsoncv: RegisterConversion called for built in conversion " + name)
+		}
+	}
+	if _, dup := conversions[name]; dup {
+		panic("bsoncv: RegisterConversion called twice for " + name)
+	}
+	conversions[name] = fn
+	// cached tags may have parsed name as an unknown conversion
+	structInfos.Range(func(key, _ interface{}) bool {
+		structInfos.Delete(key)
+		return true
+	})
+}
+
+// convertCustom runs the registered conversion for the tag
+func (b bsonConvTag) convertCustom(v reflect.Value) (interface{}, error) {
+	conversionsMu.RLock()
+	fn := conversions[b.name]
+	conversionsMu.RUnlock()
+	return fn(v, ConvTag{Name: b.name, OmitEmpty: b.omitempty, Args: b.args})
+}
+
 type bsonConvTag struct {
 	conv      convType
 	omitempty bool
+	// overrides Options.OmitEmptyByDefault
+	keepempty bool
+	// set from Options.UseNumber
+	useNumber bool
 	datefmt   string
+	location  string
+	// set for custom conversions
+	name string
+	args []string
+	// the field's keys are written at the top level of the document
+	inline bool
+	// the number of decimal places of a $money amount
+	scale string
+	// the subtype of a $binary value
+	subtype string
+	// the unit a $duration is stored in
+	unit string
+	// a conversion that isn't built in or registered, see Options.Strict
+	unknown string
 }
 
 func parseBsonConvTag(tag string) bsonConvTag {
 	parts := strings.Split(tag, ",")
+	// tags copied from examples often have a space after each comma
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
 	var t bsonConvTag
 	if len(parts) > 1 {
-		t.conv = parseConvType(parts[1])
+		if parts[1] == "inline" {
+			t.inline = true
+		} else {
+			t.conv = parseConvType(parts[1])
+			if t.conv == invalid && parts[1] != "" {
+				t.unknown = parts[1]
+			}
+		}
 	}
 	if len(parts) > 2 {
-		if parts[2] != "" {
+		if parts[2] == "keepempty" {
+			t.keepempty = true
+		} else if parts[2] != "" {
 			t.omitempty = true
 		}
 	}
+	if t.conv == custom {
+		t.name = parts[1]
+		if len(parts) > 3 {
+			t.args = parts[3:]
+		}
+	}
 	if len(parts) > 3 {
+		if t.conv == money {
+			t.scale = parts[3]
+		}
+		if t.conv == binaryConv {
+			t.subtype = parts[3]
+		}
+		if t.conv == duration {
+			t.unit = parts[3]
+		}
 		if t.conv == date {
-			if f, ok := timeFormats[parts[3]]; ok {
+			if f, ok := lookupTimeFormat(parts[3]); ok {
 				t.datefmt = f
 			} else {
 				t.datefmt = parts[3]
 			}
 		}
 	}
+	if len(parts) > 4 {
+		if t.conv == date {
+			t.location = parts[4]
+		}
+	}
 	return t
 }
 
@@ -123,25 +345,150 @@ func (b bsonConvTag) convertString(v string) (interface{}, error) {
 	if b.conv == oid {
 		return primitive.ObjectIDFromHex(v)
 	}
+	if b.conv == boolConv {
+		return parseBool(v)
+	}
+	if b.conv == duration {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		return b.convertDuration(d)
+	}
 	if b.conv == date {
-		fmt := RFC3339Milli
-		if b.datefmt != "" {
-			if tfmt, ok := timeFormats[b.datefmt]; ok {
-				fmt = tfmt
-			} else {
-				fmt = b.datefmt
+		fmt := b.layout()
+		var t time.Time
+		var err error
+		if b.location == "" {
+			t, err = time.Parse(fmt, v)
+		} else {
+			loc, lerr := time.LoadLocation(b.location)
+			if lerr != nil {
+				return nil, errors.Wrapf(lerr, "unknown location %s", b.location)
 			}
+			t, err = time.ParseInLocation(fmt, v, loc)
+		}
+		if err != nil {
+			return t, err
 		}
-		return time.Parse(fmt, v)
+		return inDateLocation(t), nil
 	}
 	return v, nil
 }
 
+// layout returns the tag's date format, RFC3339Milli by default
+func (b bsonConvTag) layout() string {
+	if b.datefmt == "" {
+		return RFC3339Milli
+	}
+	if f, ok := lookupTimeFormat(b.datefmt); ok {
+		return f
+	}
+	return b.datefmt
+}
+
+// convertTime round trips t through the tag's date format so it's stored with
+// the format's precision, e.g. DateOnly drops the time of day.
+func (b bsonConvTag) convertTime(t time.Time) (interface{}, error) {
+	if b.location != "" {
+		loc, err := time.LoadLocation(b.location)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unknown location %s", b.location)
+		}
+		t = t.In(loc)
+	}
+	return b.convertString(t.Format(b.layout()))
+}
+
+// convertToTime converts unix millis to a time.Time. Zero is the unix epoch,
+// whether it should be omitted is decided by the caller.
 func (b bsonConvTag) convertToTime(v int64) time.Time {
-	if v == 0 {
-		return time.Time{}
+	return inDateLocation(time.Unix(v/1000, v%1000*int64(time.Millisecond)))
+}
+
+// DefaultDateLocation, when set, is the location $date conversions produce
+// their time.Time values in. Setting it to time.UTC makes StructToMap output
+// independent of the server's timezone. BSON DateTime values are stored as
+// UTC millis and carry no zone, so this only affects the intermediate
+// time.Time in the map, not what ends up in the document.
+// When nil, ints convert in time.Local and strings keep their parsed zone.
+var DefaultDateLocation *time.Location
+
+func inDateLocation(t time.Time) time.Time {
+	if DefaultDateLocation == nil {
+		return t
+	}
+	return t.In(DefaultDateLocation)
+}
+
+// parseBool extends strconv.ParseBool with yes/no
+func parseBool(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "yes", "y":
+		return true, nil
+	case "no", "n":
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+func (b bsonConvTag) convertInt(v int64) (interface{}, error) {
+	if b.conv == int32Conv {
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			return nil, errors.Errorf("%d overflows int32", v)
+		}
+		return int32(v), nil
+	}
+	return v, nil
+}
+
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// convertDuration returns d as an int64 count of the tag's unit, nanoseconds
+// by default. Anything smaller than the unit is truncated.
+func (b bsonConvTag) convertDuration(d time.Duration) (interface{}, error) {
+	if b.unit == "" {
+		return int64(d), nil
 	}
-	return time.Unix(v/1000, v%1000*int64(time.Millisecond))
+	unit, ok := durationUnits[b.unit]
+	if !ok {
+		return nil, errors.Errorf("unknown $duration unit %q, use ns, us, ms, s, m or h", b.unit)
+	}
+	return int64(d / unit), nil
+}
+
+// convertMoney places the decimal point scale digits from the right of v
+func (b bsonConvTag) convertMoney(v *big.Int) (interface{}, error) {
+	scale := 2
+	if b.scale != "" {
+		s, err := strconv.Atoi(b.scale)
+		if err != nil || s < 0 || s > 34 {
+			return nil, errors.Errorf("invalid $money scale %q, it must be between 0 and 34", b.scale)
+		}
+		scale = s
+	}
+	d, ok := primitive.ParseDecimal128FromBigInt(v, -scale)
+	if !ok {
+		return nil, errors.Errorf("%s with scale %d doesn't fit in a Decimal128", v, scale)
+	}
+	return d, nil
+}
+
+func (b bsonConvTag) convertUint(v uint64) (interface{}, error) {
+	if b.conv == int32Conv && v > math.MaxInt32 {
+		return nil, errors.Errorf("%d overflows int32", v)
+	}
+	if v > math.MaxInt64 {
+		return nil, errors.Errorf("%d overflows int64", v)
+	}
+	return b.convertInt(int64(v))
 }
 
 func (b bsonConvTag) convertJSONBytes(v []byte) (interface{}, error) {
@@ -149,31 +496,595 @@ func (b bsonConvTag) convertJSONBytes(v []byte) (interface{}, error) {
 	if len(v) == 0 {
 		return i, nil
 	}
-	err := jsondec.Unmarshal(v, &i)
+	var err error
+	if b.useNumber {
+		i, err = unmarshalNumbers(v)
+	} else {
+		err = jsondec.Unmarshal(v, &i)
+	}
+	if syntaxErr, ok := err.(*jsondec.SyntaxError); ok {
+		return i, errors.Wrapf(err, "invalid json at offset %d near %q",
+			syntaxErr.Offset, jsonSnippet(v, syntaxErr.Offset))
+	}
 	return i, err
 }
 
-func StructToMap(v interface{}) (map[string]interface{}, error) {
-	if v == nil {
-		return nil, nil
+// unmarshalNumbers unmarshals v like json.Unmarshal but keeps integers that
+// fit in an int64 as int64s rather than float64s
+func unmarshalNumbers(v []byte) (interface{}, error) {
+	dec := jsondec.NewDecoder(bytes.NewReader(v))
+	dec.UseNumber()
+	var i interface{}
+	if err := dec.Decode(&i); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.Errorf("invalid json at offset %d, unexpected data after the top level value", dec.InputOffset())
+	}
+	return convertNumbers(i), nil
+}
+
+// convertNumbers replaces the json.Numbers in v with int64s or float64s
+func convertNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case jsondec.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, elem := range t {
+			t[k] = convertNumbers(elem)
+		}
+	case []interface{}:
+		for i, elem := range t {
+			t[i] = convertNumbers(elem)
+		}
+	}
+	return v
+}
+
+// jsonSnippet returns the bytes surrounding offset in v
+func jsonSnippet(v []byte, offset int64) string {
+	const radius = 16
+	start, end := offset-radius, offset+radius
+	if start < 0 {
+		start = 0
+	}
+	if end > int64(len(v)) {
+		end = int64(len(v))
 	}
-	data := make(map[string]interface{})
+	return string(v[start:end])
+}
+
+// convertElems applies the tag's conversion to each element of a slice or
+// array, e.g. a []string tagged $oid becomes []interface{} of ObjectIDs
+func (b bsonConvTag) convertElems(v reflect.Value) ([]interface{}, error) {
+	elems := make([]interface{}, v.Len())
+	for i := range elems {
+		elem := v.Index(i)
+		for (elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Interface) && !elem.IsNil() {
+			elem = elem.Elem()
+		}
+		if elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Interface {
+			continue
+		}
+		var value interface{}
+		var err error
+		switch elem.Kind() {
+		case reflect.String:
+			if b.conv == json {
+				value, err = b.convertJSONBytes([]byte(elem.String()))
+			} else {
+				value, err = b.convertString(elem.String())
+			}
+		case reflect.Slice, reflect.Array:
+			if b.conv != json || elem.Type().Elem().Kind() != reflect.Uint8 {
+				return nil, errors.Errorf("can't convert element %d of type %s", i, elem.Type())
+			}
+			value, err = b.convertJSONBytes(byteSlice(elem))
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			switch b.conv {
+			case date:
+				value = b.convertToTime(elem.Int())
+			case int32Conv, int64Conv:
+				value, err = b.convertInt(elem.Int())
+			case boolConv:
+				value = elem.Int() != 0
+			case money:
+				value, err = b.convertMoney(big.NewInt(elem.Int()))
+			case duration:
+				value, err = b.convertDuration(time.Duration(elem.Int()))
+			default:
+				return nil, errors.Errorf("can't convert element %d of type %s", i, elem.Type())
+			}
+		default:
+			return nil, errors.Errorf("can't convert element %d of type %s", i, elem.Type())
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "element %d", i)
+		}
+		elems[i] = value
+	}
+	return elems, nil
+}
+
+// convertBinary wraps v in a primitive.Binary with the tag's subtype, generic
+// by default. uuid is subtype 4 and must be 16 bytes, other subtypes are
+// numbers, e.g. 0x80 for user defined.
+func (b bsonConvTag) convertBinary(v []byte) (interface{}, error) {
+	var subtype byte
+	switch b.subtype {
+	case "":
+	case "uuid":
+		if len(v) != 16 {
+			return nil, errors.Errorf("a uuid must be 16 bytes, got %d", len(v))
+		}
+		subtype = 0x04
+	default:
+		s, err := strconv.ParseUint(b.subtype, 0, 8)
+		if err != nil {
+			return nil, errors.Errorf("invalid $binary subtype %q", b.subtype)
+		}
+		subtype = byte(s)
+	}
+	return primitive.Binary{Subtype: subtype, Data: v}, nil
+}
+
+// convertPoint builds a GeoJSON point from a "lng,lat" string or a struct with
+// float Lng and Lat (or Longitude and Latitude) fields, so it can be indexed
+// with 2dsphere.
+func (b bsonConvTag) convertPoint(v reflect.Value) (interface{}, error) {
+	var lng, lat float64
+	switch v.Kind() {
+	case reflect.String:
+		parts := strings.Split(v.String(), ",")
+		if len(parts) != 2 {
+			return nil, errors.Errorf("point %q isn't formatted lng,lat", v.String())
+		}
+		var err error
+		if lng, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid longitude %q", parts[0])
+		}
+		if lat, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid latitude %q", parts[1])
+		}
+	case reflect.Struct:
+		var hasLng, hasLat bool
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if f.Kind() != reflect.Float64 && f.Kind() != reflect.Float32 {
+				continue
+			}
+			switch strings.ToLower(v.Type().Field(i).Name) {
+			case "lng", "longitude":
+				lng, hasLng = f.Float(), true
+			case "lat", "latitude":
+				lat, hasLat = f.Float(), true
+			}
+		}
+		if !hasLng || !hasLat {
+			return nil, errors.Errorf("%s has no float Lng and Lat fields", v.Type())
+		}
+	default:
+		return nil, errors.Errorf("can't convert %s to a point", v.Type())
+	}
+	if lng < -180 || lng > 180 {
+		return nil, errors.Errorf("longitude %v is outside [-180, 180]", lng)
+	}
+	if lat < -90 || lat > 90 {
+		return nil, errors.Errorf("latitude %v is outside [-90, 90]", lat)
+	}
+	return map[string]interface{}{
+		"type":        "Point",
+		"coordinates": []float64{lng, lat},
+	}, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// convertDateRange builds a {from, to} subdocument from a [2]time.Time or a
+// struct with time.Time From and To (or Start and End) fields.
+func (b bsonConvTag) convertDateRange(v reflect.Value) (interface{}, error) {
+	var from, to time.Time
+	switch {
+	case v.Kind() == reflect.Array && v.Len() == 2 && v.Type().Elem() == timeType:
+		from, to = v.Index(0).Interface().(time.Time), v.Index(1).Interface().(time.Time)
+	case v.Kind() == reflect.Struct:
+		var hasFrom, hasTo bool
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if f.Type() != timeType || !f.CanInterface() {
+				continue
+			}
+			switch strings.ToLower(v.Type().Field(i).Name) {
+			case "from", "start":
+				from, hasFrom = f.Interface().(time.Time), true
+			case "to", "end":
+				to, hasTo = f.Interface().(time.Time), true
+			}
+		}
+		if !hasFrom || !hasTo {
+			return nil, errors.Errorf("%s has no time.Time From and To fields", v.Type())
+		}
+	default:
+		return nil, errors.Errorf("can't convert %s to a date range", v.Type())
+	}
+	if from.After(to) {
+		return nil, errors.Errorf("range from %s is after to %s",
+			from.Format(time.RFC3339Nano), to.Format(time.RFC3339Nano))
+	}
+	return map[string]interface{}{
+		"from": from,
+		"to":   to,
+	}, nil
+}
 
-	typ := reflect.TypeOf(v)
-	value := reflect.ValueOf(v)
+// convertTimestamp builds a primitive.Timestamp from seconds since the epoch,
+// an RFC3339 string, a time.Time or a struct with integer T and I fields.
+func (b bsonConvTag) convertTimestamp(v reflect.Value) (interface{}, error) {
+	var seconds int64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		seconds = v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > math.MaxUint32 {
+			return nil, errors.Errorf("%d seconds overflows a timestamp", v.Uint())
+		}
+		seconds = int64(v.Uint())
+	case reflect.String:
+		t, err := time.Parse(time.RFC3339, v.String())
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid timestamp %q", v.String())
+		}
+		seconds = t.Unix()
+	case reflect.Struct:
+		if v.Type() == timeType {
+			seconds = v.Interface().(time.Time).Unix()
+			break
+		}
+		var ts primitive.Timestamp
+		var hasT, hasI bool
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Name
+			if name != "T" && name != "I" {
+				continue
+			}
+			var n int64
+			switch f := v.Field(i); f.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				n = f.Int()
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+				n = int64(f.Uint())
+			default:
+				continue
+			}
+			if n < 0 || n > math.MaxUint32 {
+				return nil, errors.Errorf("%s %d is outside [0, %d]", name, n, uint32(math.MaxUint32))
+			}
+			if name == "T" {
+				ts.T, hasT = uint32(n), true
+			} else {
+				ts.I, hasI = uint32(n), true
+			}
+		}
+		if !hasT || !hasI {
+			return nil, errors.Errorf("%s has no integer T and I fields", v.Type())
+		}
+		return ts, nil
+	default:
+		return nil, errors.Errorf("can't convert %s to a timestamp", v.Type())
+	}
+	if seconds < 0 || seconds > math.MaxUint32 {
+		return nil, errors.Errorf("%d seconds is outside a timestamp's range", seconds)
+	}
+	return primitive.Timestamp{T: uint32(seconds)}, nil
+}
+
+// byteSlice returns the bytes of a byte slice or array
+func byteSlice(v reflect.Value) []byte {
+	if v.Kind() == reflect.Slice {
+		return v.Bytes()
+	}
+	bytes := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(bytes), v)
+	return bytes
+}
+
+// marshalJSON round trips v through json so it's stored as the generic
+// subdocument its json represents.
+func (b bsonConvTag) marshalJSON(v interface{}) (interface{}, error) {
+	bytes, err := jsondec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return b.convertJSONBytes(bytes)
+}
+
+// Options control how StructToMapWithOptions converts a struct
+type Options struct {
+	// NilAsNull writes nil pointers as BSON null, otherwise they're omitted.
+	// Fields tagged omitempty are omitted when nil either way.
+	NilAsNull bool
+	// OmitEmptyByDefault treats every field as if it were tagged omitempty
+	// unless it's tagged keepempty, e.g. bsoncv:"count,,keepempty". Empty is
+	// the zero value for strings, numbers, bools, times and structs, nil for
+	// pointers and no elements for slices and maps.
+	OmitEmptyByDefault bool
+	// UseNumber keeps integers in $json values as int64s instead of float64s so
+	// large ones don't lose precision. Numbers with a fraction or exponent, or
+	// that overflow an int64, are still float64s.
+	UseNumber bool
+	// Strict returns an error for a conversion that isn't built in or
+	// registered, e.g. a $objectid typo, instead of leaving the field as is. It
+	// also rejects fields bson can't hold, channels, funcs, complex numbers and
+	// unsafe pointers, naming them rather than leaving bson.Marshal to fail.
+	Strict bool
+
+	// the structs being converted further up, see writeStruct
+	parents *[]visit
+}
+
+// visit is a struct in memory, the type tells a struct from its first field
+type visit struct {
+	addr uintptr
+	typ  reflect.Type
+}
+
+// StructToMap converts v, a struct or a pointer to one, using the bsoncv tags.
+// A nil pointer returns a nil map. Nil pointer fields are written as BSON null
+// unless they're tagged omitempty.
+func StructToMap(v interface{}) (map[string]interface{}, error) {
+	return StructToMapWithOptions(v, Options{NilAsNull: true})
+}
+
+func StructToMapWithOptions(v interface{}, opts Options) (map[string]interface{}, error) {
+	return structToMap(v, opts, "")
+}
+
+// structField is what structToMap needs to know about a field that doesn't
+// depend on its value
+type structField struct {
+	index int
+	name  string
+	typ   reflect.Type
+	tag   bsonConvTag
+}
+
+// structInfo is a struct type's fields with their names and tags parsed.
+// Omitted fields are left out.
+type structInfo struct {
+	fields []structField
+	// the names of the fields that aren't inline
+	declared map[string]bool
+}
+
+// structInfos caches a *structInfo per reflect.Type. Tags can name registered
+// conversions, so RegisterConversion clears it.
+var structInfos sync.Map
+
+func cachedStructInfo(typ reflect.Type) *structInfo {
+	if info, ok := structInfos.Load(typ); ok {
+		return info.(*structInfo)
+	}
+	info := &structInfo{declared: make(map[string]bool, typ.NumField())}
 	for i := 0; i < typ.NumField(); i++ {
 		field := typ.Field(i)
-
 		name := fieldName(field)
-		// omit this field
+		// omit this field, checked before anything else so "-" works the same
+		// for every kind
 		if name == "-" {
 			continue
 		}
 		tag := parseBsonConvTag(field.Tag.Get("bsoncv"))
-		fieldValue := value.Field(i)
-		if fieldValue.Kind() == reflect.Ptr {
+		if !tag.inline {
+			info.declared[name] = true
+		}
+		info.fields = append(info.fields, structField{index: i, name: name, typ: field.Type, tag: tag})
+	}
+	// another goroutine may have stored the same type, either copy is fine
+	structInfos.Store(typ, info)
+	return info
+}
+
+// structValue returns the struct v holds. Pointers are dereferenced so &doc
+// converts the same as doc, ok is false if v is invalid or a nil pointer.
+func structValue(v reflect.Value) (value reflect.Value, ok bool, err error) {
+	if !v.IsValid() {
+		return v, false, nil
+	}
+	value = v
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return value, false, nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return value, false, errors.Errorf("bsoncv: StructToMap requires a struct, got %s", v.Type())
+	}
+	return value, true, nil
+}
+
+// docWriter receives the converted fields of a struct, mapWriter builds the
+// map StructToMap returns and bsonWriter the document AppendBSON writes.
+type docWriter interface {
+	put(name string, value interface{})
+	// putStruct converts the struct v as a subdocument, path prefixes its
+	// field names in errors
+	putStruct(name string, v reflect.Value, opts Options, path string) error
+	// putStructs converts v, see hasStructElems, as an array of subdocuments
+	putStructs(name string, v reflect.Value, opts Options, path string) error
+}
+
+type mapWriter map[string]interface{}
+
+func (m mapWriter) put(name string, value interface{}) {
+	m[name] = value
+}
+
+func (m mapWriter) putStruct(name string, v reflect.Value, opts Options, path string) error {
+	nested, err := valueToMap(v, opts, path)
+	if err != nil {
+		return err
+	}
+	m[name] = nested
+	return nil
+}
+
+func (m mapWriter) putStructs(name string, v reflect.Value, opts Options, path string) error {
+	elems, err := structElems(v, opts, path)
+	if err != nil {
+		return err
+	}
+	m[name] = elems
+	return nil
+}
+
+// structToMap converts v, prefixing field names in errors with path so errors
+// in nested structs name the full path, e.g. order.customer._id
+func structToMap(v interface{}, opts Options, path string) (map[string]interface{}, error) {
+	return valueToMap(reflect.ValueOf(v), opts, path)
+}
+
+// valueToMap is structToMap for a reflect.Value, which keeps a struct reached
+// through a pointer addressable so writeStruct can detect cycles
+func valueToMap(v reflect.Value, opts Options, path string) (map[string]interface{}, error) {
+	value, ok, err := structValue(v)
+	if !ok {
+		return nil, err
+	}
+	data := make(mapWriter)
+	if err := writeStruct(value, opts, path, data); err != nil {
+		return data, err
+	}
+	return data, nil
+}
+
+// writeStruct converts the fields of the struct value to w
+func writeStruct(value reflect.Value, opts Options, path string, w docWriter) error {
+	// a struct that's reached again through a pointer while it's still being
+	// converted would be converted forever
+	if value.CanAddr() {
+		if opts.parents == nil {
+			opts.parents = new([]visit)
+		}
+		v := visit{addr: value.UnsafeAddr(), typ: value.Type()}
+		for _, parent := range *opts.parents {
+			if parent == v {
+				return errors.Errorf(
+					"bsoncv field %s refers back to a %s it's nested in", strings.TrimSuffix(path, "."), v.typ)
+			}
+		}
+		*opts.parents = append(*opts.parents, v)
+		defer func() {
+			*opts.parents = (*opts.parents)[:len(*opts.parents)-1]
+		}()
+	}
+	info := cachedStructInfo(value.Type())
+	// inline maps are merged once every declared field name is known
+	var inline []reflect.Value
+	for _, f := range info.fields {
+		name := f.name
+		fieldPath := path + name
+		// a copy, the options below change it for this call only
+		tag := f.tag
+		if tag.inline {
+			if f.typ.Kind() != reflect.Map || f.typ.Key().Kind() != reflect.String {
+				return errors.Errorf(
+					"bsoncv inline field %s must be a map with string keys, got %s", fieldPath, f.typ)
+			}
+			inline = append(inline, value.Field(f.index))
+			continue
+		}
+		if opts.Strict && tag.unknown != "" {
+			return errors.Errorf(
+				"bsoncv unknown conversion %s for field %s", tag.unknown, fieldPath)
+		}
+		if opts.OmitEmptyByDefault && !tag.keepempty {
+			tag.omitempty = true
+		}
+		tag.useNumber = opts.UseNumber
+		// pointers and interfaces are converted as the value they hold
+		fieldValue := value.Field(f.index)
+		for (fieldValue.Kind() == reflect.Ptr || fieldValue.Kind() == reflect.Interface) && !fieldValue.IsNil() {
 			fieldValue = fieldValue.Elem()
 		}
+		if fieldValue.Kind() == reflect.Ptr || fieldValue.Kind() == reflect.Interface {
+			if opts.NilAsNull && !tag.omitempty {
+				w.put(name, nil)
+			}
+			continue
+		}
+		// raw json is always stored as the subdocument it represents
+		if tag.conv == invalid && (fieldValue.Type() == rawMessageType || fieldValue.Type() == rawJSONType) {
+			tag.conv = json
+		}
+		// conversions decide what's empty for themselves
+		if tag.omitempty && tag.conv == invalid && isEmpty(fieldValue) {
+			continue
+		}
+
+		// types that encode themselves are left to the driver
+		if tag.conv == invalid {
+			if m, ok := bsonMarshaler(fieldValue); ok {
+				w.put(name, m)
+				continue
+			}
+		}
+		if tag.conv == point {
+			if fieldValue.IsZero() && tag.omitempty {
+				continue
+			}
+			value, err := tag.convertPoint(fieldValue)
+			if err != nil {
+				return errors.Wrapf(err,
+					"bsoncv failed to convert %s to $point for field %s",
+					fieldValue.Type(), fieldPath)
+			}
+			w.put(name, value)
+			continue
+		}
+		if tag.conv == daterange {
+			if fieldValue.IsZero() && tag.omitempty {
+				continue
+			}
+			value, err := tag.convertDateRange(fieldValue)
+			if err != nil {
+				return errors.Wrapf(err,
+					"bsoncv failed to convert %s to $daterange for field %s",
+					fieldValue.Type(), fieldPath)
+			}
+			w.put(name, value)
+			continue
+		}
+		if tag.conv == timestamp {
+			if fieldValue.IsZero() && tag.omitempty {
+				continue
+			}
+			value, err := tag.convertTimestamp(fieldValue)
+			if err != nil {
+				return errors.Wrapf(err,
+					"bsoncv failed to convert %s to $timestamp for field %s",
+					fieldValue.Type(), fieldPath)
+			}
+			w.put(name, value)
+			continue
+		}
+		if tag.conv == custom {
+			if fieldValue.IsZero() && tag.omitempty {
+				continue
+			}
+			value, err := tag.convertCustom(fieldValue)
+			if err != nil {
+				return errors.Wrapf(err,
+					"bsoncv failed to convert %s to %s for field %s",
+					fieldValue.Type(), tag.name, fieldPath)
+			}
+			w.put(name, value)
+			continue
+		}
 
 		switch fieldValue.Kind() {
 		case reflect.String:
@@ -182,70 +1093,296 @@ func StructToMap(v interface{}) (map[string]interface{}, error) {
 				if fv != "" || !tag.omitempty {
 					value, err := tag.convertString(fv)
 					if err != nil {
-						return data, errors.Wrapf(err,
+						return errors.Wrapf(err,
 							"bsoncv failed to convert string |%s| to %s for field %s",
-							fv, convTypeNames[tag.conv], name)
+							fv, convTypeNames[tag.conv], fieldPath)
 					}
-					data[name] = value
+					// a $date that parses to the zero time is still empty
+					if t, ok := value.(time.Time); ok && t.IsZero() && tag.omitempty {
+						continue
+					}
+					if b, ok := value.(bool); ok && !b && tag.omitempty {
+						continue
+					}
+					w.put(name, value)
 				}
 			} else {
-				data[name] = fieldValue.Interface()
+				w.put(name, fieldValue.Interface())
 			}
-		case reflect.Int, reflect.Int64:
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 			if tag.conv == date {
 				fv := fieldValue.Int()
 				if fv != 0 || !tag.omitempty {
-					data[name] = tag.convertToTime(fv)
+					w.put(name, tag.convertToTime(fv))
 				}
-			} else {
-				data[name] = fieldValue.Interface()
+			} else if tag.conv == int32Conv || tag.conv == int64Conv {
+				fv := fieldValue.Int()
+				if fv != 0 || !tag.omitempty {
+					value, err := tag.convertInt(fv)
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert int %d to %s for field %s",
+							fv, convTypeNames[tag.conv], fieldPath)
+					}
+					w.put(name, value)
+				}
+			} else if tag.conv == boolConv {
+				fv := fieldValue.Int()
+				if fv != 0 || !tag.omitempty {
+					w.put(name, fv != 0)
+				}
+			} else if tag.conv == duration {
+				fv := fieldValue.Int()
+				if fv != 0 || !tag.omitempty {
+					value, err := tag.convertDuration(time.Duration(fv))
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert int %d to %s for field %s",
+							fv, convTypeNames[tag.conv], fieldPath)
+					}
+					w.put(name, value)
+				}
+			} else if tag.conv == money {
+				fv := fieldValue.Int()
+				if fv != 0 || !tag.omitempty {
+					value, err := tag.convertMoney(big.NewInt(fv))
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert int %d to %s for field %s",
+							fv, convTypeNames[tag.conv], fieldPath)
+					}
+					w.put(name, value)
+				}
+			} else if fieldValue.Int() != 0 || !tag.omitempty {
+				w.put(name, fieldValue.Interface())
 			}
-		case reflect.Slice:
-			if tag.conv == json {
-				fv := fieldValue.Interface()
-				if fv == nil || !tag.omitempty {
-					if bytes, ok := fv.([]byte); ok {
-						if len(bytes) > 0 || !tag.omitempty {
-							jsonGoInterfaces, err := tag.convertJSONBytes(bytes)
-							if err != nil {
-								return data, errors.Wrapf(err,
-									"bsoncv failed to convert jsonbytes %s for field %s",
-									string(bytes), name)
-							}
-							data[name] = jsonGoInterfaces
-						}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if tag.conv == int32Conv || tag.conv == int64Conv {
+				fv := fieldValue.Uint()
+				if fv != 0 || !tag.omitempty {
+					value, err := tag.convertUint(fv)
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert uint %d to %s for field %s",
+							fv, convTypeNames[tag.conv], fieldPath)
+					}
+					w.put(name, value)
+				}
+			} else if tag.conv == boolConv {
+				fv := fieldValue.Uint()
+				if fv != 0 || !tag.omitempty {
+					w.put(name, fv != 0)
+				}
+			} else if tag.conv == money {
+				fv := fieldValue.Uint()
+				if fv != 0 || !tag.omitempty {
+					value, err := tag.convertMoney(new(big.Int).SetUint64(fv))
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert uint %d to %s for field %s",
+							fv, convTypeNames[tag.conv], fieldPath)
 					}
+					w.put(name, value)
 				}
+			} else if fieldValue.Uint() != 0 || !tag.omitempty {
+				w.put(name, fieldValue.Interface())
+			}
+		case reflect.Slice, reflect.Array:
+			isBytes := fieldValue.Type().Elem().Kind() == reflect.Uint8
+			// byte slices of any named type, e.g. RawJSON, hold the json
+			if tag.conv == json && isBytes {
+				bytes := byteSlice(fieldValue)
+				if len(bytes) > 0 || !tag.omitempty {
+					jsonGoInterfaces, err := tag.convertJSONBytes(bytes)
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert jsonbytes %s for field %s",
+							string(bytes), fieldPath)
+					}
+					w.put(name, jsonGoInterfaces)
+				}
+			} else if isBytes && (tag.conv == binaryConv || tag.conv == invalid && fieldValue.Kind() == reflect.Slice && !fieldValue.IsNil()) {
+				// raw bytes, $binary only to pick the subtype. Untagged arrays,
+				// e.g. primitive.ObjectID, fall through to the driver.
+				if fieldValue.Len() > 0 || !tag.omitempty {
+					value, err := tag.convertBinary(byteSlice(fieldValue))
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert %s to $binary for field %s",
+							fieldValue.Type(), fieldPath)
+					}
+					w.put(name, value)
+				}
+			} else if tag.conv != invalid && !isBytes {
+				if fieldValue.Len() > 0 || !tag.omitempty {
+					elems, err := tag.convertElems(fieldValue)
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert %s to %s for field %s",
+							fieldValue.Type(), convTypeNames[tag.conv], fieldPath)
+					}
+					w.put(name, elems)
+				}
+			} else if tag.conv == invalid && hasStructElems(fieldValue.Type()) && !(fieldValue.Kind() == reflect.Slice && fieldValue.IsNil()) {
+				if fieldValue.Len() > 0 || !tag.omitempty {
+					if err := w.putStructs(name, fieldValue, opts, fieldPath+"."); err != nil {
+						return err
+					}
+				}
+			} else if fieldValue.Len() > 0 || !tag.omitempty {
+				w.put(name, fieldValue.Interface())
 			}
 		case reflect.Struct:
 			if tag.conv == json {
-				if wrapper, ok := fieldValue.Interface().(jsonWrapper); ok {
-					jsonGoInterfaces, err := tag.convertJSONBytes(wrapper.JsonBytes())
+				var jsonBytes []byte
+				var isWrapper bool
+				if wrapper, ok := fieldValue.Interface().(jsonErrWrapper); ok {
+					b, err := wrapper.JsonBytesErr()
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to get jsonbytes for field %s", fieldPath)
+					}
+					jsonBytes, isWrapper = b, true
+				} else if wrapper, ok := fieldValue.Interface().(jsonWrapper); ok {
+					jsonBytes, isWrapper = wrapper.JsonBytes(), true
+				}
+				if isWrapper {
+					jsonGoInterfaces, err := tag.convertJSONBytes(jsonBytes)
 					if err != nil {
-						return data, errors.Wrapf(err,
+						return errors.Wrapf(err,
 							"bsoncv failed to convert jsonbytes %s for field %s",
-							string(wrapper.JsonBytes()), name)
+							string(jsonBytes), fieldPath)
+					}
+					w.put(name, jsonGoInterfaces)
+				} else {
+					jsonGoInterfaces, err := tag.marshalJSON(fieldValue.Interface())
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert %s to json for field %s",
+							fieldValue.Type(), fieldPath)
+					}
+					w.put(name, jsonGoInterfaces)
+				}
+			} else if t, ok := fieldValue.Interface().(time.Time); ok {
+				if !t.IsZero() || !tag.omitempty {
+					if tag.conv == date && tag.datefmt != "" {
+						value, err := tag.convertTime(t)
+						if err != nil {
+							return errors.Wrapf(err,
+								"bsoncv failed to convert time %s to %s for field %s",
+								t, convTypeNames[tag.conv], fieldPath)
+						}
+						w.put(name, value)
+					} else {
+						w.put(name, t)
 					}
-					data[name] = jsonGoInterfaces
 				}
-			} else if _, ok := fieldValue.Interface().(time.Time); ok {
-				data[name] = fieldValue.Interface()
 			} else {
-				str, err := StructToMap(fieldValue.Interface())
-				if err != nil {
-					return data, err
+				if err := w.putStruct(name, fieldValue, opts, fieldPath+"."); err != nil {
+					return err
+				}
+			}
+		case reflect.Map:
+			if tag.conv == json {
+				if !fieldValue.IsNil() || !tag.omitempty {
+					jsonGoInterfaces, err := tag.marshalJSON(fieldValue.Interface())
+					if err != nil {
+						return errors.Wrapf(err,
+							"bsoncv failed to convert %s to json for field %s",
+							fieldValue.Type(), fieldPath)
+					}
+					w.put(name, jsonGoInterfaces)
 				}
-				data[name] = str
+			} else {
+				w.put(name, fieldValue.Interface())
+			}
+		case reflect.Bool:
+			// false is empty whatever the conversion
+			if fieldValue.Bool() || !tag.omitempty {
+				w.put(name, fieldValue.Interface())
 			}
-		case reflect.Invalid:
-			if !tag.omitempty {
-				data[name] = nil
+		case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+			if opts.Strict {
+				return errors.Errorf(
+					"bsoncv can't store field %s of kind %s", fieldPath, fieldValue.Kind())
 			}
+			w.put(name, fieldValue.Interface())
 		default:
-			data[name] = fieldValue.Interface()
+			w.put(name, fieldValue.Interface())
 		}
 	}
-	return data, nil
+	for _, m := range inline {
+		iter := m.MapRange()
+		for iter.Next() {
+			key := iter.Key().String()
+			if info.declared[key] {
+				return errors.Errorf(
+					"bsoncv inline key %s collides with a field of the same name", path+key)
+			}
+			w.put(key, iter.Value().Interface())
+		}
+	}
+	return nil
+}
+
+var (
+	marshalerType      = reflect.TypeOf((*bson.Marshaler)(nil)).Elem()
+	valueMarshalerType = reflect.TypeOf((*bson.ValueMarshaler)(nil)).Elem()
+)
+
+// hasStructElems reports whether t is a slice or array of structs, or pointers
+// to them, that bsoncv converts itself. Times and types that marshal themselves
+// are left to the driver.
+func hasStructElems(t reflect.Type) bool {
+	elem := t.Elem()
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct || elem == timeType {
+		return false
+	}
+	_, ok := bsonMarshaler(reflect.New(elem).Elem())
+	return !ok
+}
+
+// structElems converts each element of v, see hasStructElems, so the bsoncv
+// tags of its fields apply. Nil pointers become nil maps.
+func structElems(v reflect.Value, opts Options, path string) ([]map[string]interface{}, error) {
+	elems := make([]map[string]interface{}, v.Len())
+	for i := range elems {
+		m, err := valueToMap(v.Index(i), opts, path+strconv.Itoa(i)+".")
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = m
+	}
+	return elems, nil
+}
+
+// bsonMarshaler returns v, or a pointer to a copy of v if the methods have
+// pointer receivers, when it implements bson.Marshaler or bson.ValueMarshaler
+func bsonMarshaler(v reflect.Value) (interface{}, bool) {
+	if t := v.Type(); t.Implements(valueMarshalerType) || t.Implements(marshalerType) {
+		return v.Interface(), true
+	}
+	if pt := reflect.PtrTo(v.Type()); pt.Implements(valueMarshalerType) || pt.Implements(marshalerType) {
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		return ptr.Interface(), true
+	}
+	return nil, false
+}
+
+// isEmpty reports whether v is empty for omitempty, see OmitEmptyByDefault
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Float32, reflect.Float64:
+		// IsZero is false for -0
+		return v.Float() == 0
+	}
+	return v.IsZero()
 }
 
 func ToBson(v interface{}) ([]byte, error) {
@@ -253,16 +1390,151 @@ func ToBson(v interface{}) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to convert struct to map")
 	}
+	// a nil pointer
+	if data == nil {
+		return nil, nil
+	}
 	return bson.Marshal(data)
 }
 
+// AppendBSON appends v, a struct or a pointer to one, to dst as the bson
+// document ToBson returns. The fields are written in struct order as they're
+// converted, without building the map StructToMap returns, so large documents
+// aren't held in memory twice. A nil pointer appends nothing.
+func AppendBSON(dst []byte, v interface{}) ([]byte, error) {
+	return AppendBSONWithOptions(dst, v, Options{NilAsNull: true})
+}
+
+// AppendBSONWithOptions is AppendBSON with the options StructToMapWithOptions takes
+func AppendBSONWithOptions(dst []byte, v interface{}, opts Options) ([]byte, error) {
+	value, ok, err := structValue(reflect.ValueOf(v))
+	if !ok {
+		return dst, err
+	}
+	w := &bsonWriter{buf: dst}
+	if err := w.writeDoc(value, opts, ""); err != nil {
+		return dst, errors.Wrap(err, "failed to convert struct to bson")
+	}
+	return w.buf, nil
+}
+
+// WriteBSON writes v to out as the bson document ToBson returns, see AppendBSON
+func WriteBSON(out io.Writer, v interface{}) error {
+	bsn, err := AppendBSON(nil, v)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(bsn)
+	return errors.WithStack(err)
+}
+
+// bsonWriter appends converted fields to buf as bson elements
+type bsonWriter struct {
+	buf []byte
+	// prefixes field names in errors
+	path string
+	// the first error put ran into, the rest of the document is skipped
+	err error
+}
+
+func (w *bsonWriter) header(t byte, name string) {
+	if strings.IndexByte(name, 0) >= 0 {
+		w.err = errors.Errorf("bsoncv field name %q contains a null byte", w.path+name)
+		return
+	}
+	w.buf = append(w.buf, t)
+	w.buf = append(w.buf, name...)
+	w.buf = append(w.buf, Terminal)
+}
+
+func (w *bsonWriter) put(name string, value interface{}) {
+	if w.err != nil {
+		return
+	}
+	if value == nil {
+		w.header(Null, name)
+		return
+	}
+	t, b, err := bson.MarshalValue(value)
+	if err != nil {
+		w.err = errors.Wrapf(err, "bsoncv failed to marshal field %s", w.path+name)
+		return
+	}
+	w.header(byte(t), name)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *bsonWriter) putStruct(name string, v reflect.Value, opts Options, path string) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.header(Object, name)
+	return w.writeDoc(v, opts, path)
+}
+
+func (w *bsonWriter) putStructs(name string, v reflect.Value, opts Options, path string) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.header(Array, name)
+	start := w.start()
+	for i := 0; i < v.Len(); i++ {
+		elem, ok, err := structValue(v.Index(i))
+		if err != nil {
+			return err
+		}
+		key := strconv.Itoa(i)
+		if !ok {
+			w.header(Null, key)
+			continue
+		}
+		w.header(Object, key)
+		if err := w.writeDoc(elem, opts, path+key+"."); err != nil {
+			return err
+		}
+	}
+	return w.end(start)
+}
+
+// writeDoc writes the struct v as a document
+func (w *bsonWriter) writeDoc(v reflect.Value, opts Options, path string) error {
+	start := w.start()
+	parent := w.path
+	w.path = path
+	err := writeStruct(v, opts, path, w)
+	w.path = parent
+	if err != nil {
+		return err
+	}
+	return w.end(start)
+}
+
+// start reserves the length of a document or array and returns its offset
+func (w *bsonWriter) start() int {
+	start := len(w.buf)
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	return start
+}
+
+// end terminates the document or array begun at start and fills in its length
+func (w *bsonWriter) end(start int) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.buf = append(w.buf, Terminal)
+	binary.LittleEndian.PutUint32(w.buf[start:], uint32(len(w.buf)-start))
+	return nil
+}
+
 // Returns the field name to be used as the e_name in the bson spec.
 // This order of priority is used:
 // 1. alias name in the bsoncv tag
 // 2. alias name in the bson tag
 // 3. alias name in the json tag
 // 4. the field name
-// if bsoncv, or bson tags are "-" "" is returned
+// "-" in any of the tags omits the field unless a higher priority tag names it,
+// so json:"-" bson:"secret" is written as secret but json:"-" alone is omitted.
+// "-" is returned for omitted fields.
 func fieldName(f reflect.StructField) string {
 	// note that this is in priority order, the later tags override the earlier ones
 	tagsToCheck := []string{"json", "bson", "bsoncv"}
@@ -272,10 +1544,7 @@ func fieldName(f reflect.StructField) string {
 		if b := f.Tag.Get(key); b != "" {
 			if components := strings.Split(b, ","); len(components) > 0 {
 				if n := strings.TrimSpace(components[0]); n != "" {
-					// don't omit from bsoncv if json is '-'
-					if !(key == "json" && n == "-") {
-						name = n
-					}
+					name = n
 				}
 			}
 		}
@@ -299,6 +1568,29 @@ var timeFormats = map[string]string{
 	"StampMilli":  time.StampMilli,
 	"StampMicro":  time.StampMicro,
 	"StampNano":   time.StampNano,
+	// aliases
+	"ISO8601":      time.RFC3339,
+	"RFC3339Milli": RFC3339Milli,
+	"DateTime":     "2006-01-02 15:04:05",
+	"DateOnly":     "2006-01-02",
+	"TimeOnly":     "15:04:05",
+}
+
+// timeFormats keyed by lower case name so format names can be matched
+// case-insensitively.
+var lowerTimeFormats = func() map[string]string {
+	formats := make(map[string]string, len(timeFormats))
+	for name, f := range timeFormats {
+		formats[strings.ToLower(name)] = f
+	}
+	return formats
+}()
+
+// Returns the layout for a named time format, ignoring case. If the name isn't
+// known false is returned and the caller should treat it as a literal layout.
+func lookupTimeFormat(name string) (string, bool) {
+	f, ok := lowerTimeFormats[strings.ToLower(name)]
+	return f, ok
 }
 
 const RFC3339Milli = "2006-01-02T15:04:05.000Z07:00"
@@ -308,3 +1600,42 @@ type jsonWrapper interface {
 	// rather than simply marshalling to json. Valid json is expected.
 	JsonBytes() []byte
 }
+
+// RawJSON holds raw json for a $json field. It's stored as the subdocument the
+// json represents and, like json.RawMessage, decodes back to the raw bytes.
+// Both are treated as $json without the tag:
+//
+//	type Event struct {
+//		Payload bsoncv.RawJSON `bsoncv:"payload,$json,omitempty"`
+//	}
+type RawJSON []byte
+
+var (
+	rawMessageType = reflect.TypeOf(jsondec.RawMessage{})
+	rawJSONType    = reflect.TypeOf(RawJSON{})
+)
+
+func (r RawJSON) JsonBytes() []byte {
+	return r
+}
+
+func (r RawJSON) MarshalJSON() ([]byte, error) {
+	if r == nil {
+		return []byte("null"), nil
+	}
+	return r, nil
+}
+
+func (r *RawJSON) UnmarshalJSON(data []byte) error {
+	if r == nil {
+		return errors.New("bsoncv.RawJSON: UnmarshalJSON on nil pointer")
+	}
+	*r = append((*r)[0:0], data...)
+	return nil
+}
+
+// jsonErrWrapper is preferred over jsonWrapper for types that build their json
+// lazily and can fail, the error is returned from StructToMap.
+type jsonErrWrapper interface {
+	JsonBytesErr() ([]byte, error)
+}
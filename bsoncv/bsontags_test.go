@@ -1,11 +1,20 @@
 package bsoncv_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/dustinevan/chron"
+	"github.com/dustinevan/mongo/bsoncv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"mongo/bsoncv"
+	"math"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -251,7 +260,7 @@ var (
 				Msg3:       nil,
 			},
 			expected: map[string]interface{}{
-				"intDate1": time.Time{},
+				"intDate1": time.Unix(0, 0),
 				"msg1":     nil,
 			},
 		},
@@ -318,6 +327,250 @@ var (
 					Time.Local().Format(bsoncv.RFC3339Milli),
 			},
 		},
+		{
+			caseNum: 14,
+			name:    "It writes nil struct pointers as null unless omitempty is set",
+			testStruct: struct {
+				Nested1 *Nested `bsoncv:"nested1"`
+				Nested2 *Nested `bsoncv:"nested2,,omitempty"`
+			}{
+				Nested1: nil,
+				Nested2: nil,
+			},
+			expected: map[string]interface{}{
+				"nested1": nil,
+			},
+		},
+		{
+			caseNum: 15,
+			name:    "It omits zero times when omitempty is set",
+			testStruct: struct {
+				Created1 time.Time `bsoncv:"created1,,omitempty"`
+				Created2 time.Time `bsoncv:"created2,,omitempty"`
+				Created3 time.Time `bsoncv:"created3"`
+				Date1    string    `bsoncv:"date1,$date,omitempty"`
+			}{
+				Created1: time.Time{},
+				Created2: chron.NewYear(2020).Time,
+				Created3: time.Time{},
+				Date1:    time.Time{}.Format(bsoncv.RFC3339Milli),
+			},
+			expected: map[string]interface{}{
+				"created2": chron.NewYear(2020).Time,
+				"created3": time.Time{},
+			},
+		},
+		{
+			caseNum: 16,
+			name:    "It matches date format names case-insensitively and supports aliases",
+			testStruct: struct {
+				Date1 string `bsoncv:"date1,$date,,rfc3339"`
+				Date2 string `bsoncv:"date2,$date,,iso8601"`
+				Date3 string `bsoncv:"date3,$date,,RFC3339Milli"`
+				Date4 string `bsoncv:"date4,$date,,dateonly"`
+				Date5 string `bsoncv:"date5,$date,,TimeOnly"`
+			}{
+				Date1: chron.NewDay(2025, time.July, 14).Time.Format(time.RFC3339),
+				Date2: chron.NewDay(2025, time.July, 14).Time.Format(time.RFC3339),
+				Date3: chron.NewMilli(2020, time.January, 13, 11, 32, 13, 222).Time.Format(bsoncv.RFC3339Milli),
+				Date4: "2025-07-14",
+				Date5: "11:32:13",
+			},
+			expected: map[string]interface{}{
+				"date1": chron.NewDay(2025, time.July, 14).Time,
+				"date2": chron.NewDay(2025, time.July, 14).Time,
+				"date3": chron.NewMilli(2020, time.January, 13, 11, 32, 13, 222).Time,
+				"date4": chron.NewDay(2025, time.July, 14).Time,
+				"date5": time.Date(0, time.January, 1, 11, 32, 13, 0, time.UTC),
+			},
+		},
+		{
+			caseNum: 17,
+			name:    "It converts integer widths",
+			testStruct: struct {
+				Count1 int    `bsoncv:"count1,$int32"`
+				Count2 uint64 `bsoncv:"count2,$int32"`
+				Total1 int32  `bsoncv:"total1,$int64"`
+				Total2 uint   `bsoncv:"total2,$int64"`
+				Total3 int    `bsoncv:"total3,$int64,omitempty"`
+			}{
+				Count1: 12,
+				Count2: 13,
+				Total1: 14,
+				Total2: 15,
+				Total3: 0,
+			},
+			expected: map[string]interface{}{
+				"count1": int32(12),
+				"count2": int32(13),
+				"total1": int64(14),
+				"total2": int64(15),
+			},
+		},
+		{
+			caseNum: 18,
+			name:    "It converts strings and ints to booleans",
+			testStruct: struct {
+				Str1 string `bsoncv:"str1,$bool"`
+				Str2 string `bsoncv:"str2,$bool"`
+				Str3 string `bsoncv:"str3,$bool"`
+				Str4 string `bsoncv:"str4,$bool"`
+				Str5 string `bsoncv:"str5,$bool,omitempty"`
+				Str6 string `bsoncv:"str6,$bool,omitempty"`
+				Int1 int    `bsoncv:"int1,$bool"`
+				Int2 uint8  `bsoncv:"int2,$bool"`
+				Int3 int    `bsoncv:"int3,$bool,omitempty"`
+			}{
+				Str1: "true",
+				Str2: "1",
+				Str3: "Yes",
+				Str4: "no",
+				Str5: "false",
+				Str6: "",
+				Int1: 7,
+				Int2: 0,
+				Int3: 0,
+			},
+			expected: map[string]interface{}{
+				"str1": true,
+				"str2": true,
+				"str3": true,
+				"str4": false,
+				"int1": true,
+				"int2": false,
+			},
+		},
+		{
+			caseNum: 19,
+			name:    "It handles time pointers",
+			testStruct: struct {
+				Deleted1 *time.Time `bsoncv:"deleted1,$date,omitempty"`
+				Deleted2 *time.Time `bsoncv:"deleted2,$date"`
+				Deleted3 *time.Time `bsoncv:"deleted3,$date,omitempty,DateOnly"`
+				Deleted4 *time.Time `bsoncv:"deleted4"`
+			}{
+				Deleted1: nil,
+				Deleted2: nil,
+				Deleted3: timePtr(chron.NewMilli(2020, time.January, 13, 11, 32, 13, 222).Time),
+				Deleted4: timePtr(chron.NewMilli(2020, time.January, 13, 11, 32, 13, 222).Time),
+			},
+			expected: map[string]interface{}{
+				"deleted2": nil,
+				"deleted3": chron.NewDay(2020, time.January, 13).Time,
+				"deleted4": chron.NewMilli(2020, time.January, 13, 11, 32, 13, 222).Time,
+			},
+		},
+		{
+			caseNum: 20,
+			name:    "It omits json \"-\" fields unless bson or bsoncv names them",
+			testStruct: struct {
+				Internal string `json:"-"`
+				Secret1  string `json:"-" bson:"secret1"`
+				Secret2  string `json:"-" bsoncv:"secret2"`
+				Secret3  string `json:"-" bsoncv:",$oid"`
+			}{
+				Internal: "internal",
+				Secret1:  "secret1",
+				Secret2:  "secret2",
+				Secret3:  "0123456789abcdef01234567",
+			},
+			expected: map[string]interface{}{
+				"secret1": "secret1",
+				"secret2": "secret2",
+			},
+		},
+		{
+			caseNum: 21,
+			name:    "It omits bson and bsoncv \"-\" fields of every kind",
+			testStruct: struct {
+				String1 string                   `bson:"-"`
+				String2 string                   `bsoncv:"-,$oid"`
+				Int1    int                      `bson:"-"`
+				Int2    int                      `bsoncv:"-,$date"`
+				Slice1  []byte                   `bson:"-"`
+				Slice2  []byte                   `bsoncv:"-,$json"`
+				Struct1 Nested                   `bson:"-"`
+				Struct2 CoolJSONWrapperShowOffer `bsoncv:"-,$json"`
+				Time    time.Time                `bson:"-"`
+				Ptr1    *Nested                  `bson:"-"`
+				Ptr2    *string                  `bsoncv:"-"`
+				Float   float64                  `bson:"-"`
+				Kept    string                   `bson:"-" bsoncv:"kept"`
+			}{
+				String1: "not an id",
+				String2: "not an id",
+				Int1:    1,
+				Int2:    2,
+				Slice1:  []byte("not json"),
+				Slice2:  []byte("not json"),
+				Struct1: Nested{ID: "not an id"},
+				Struct2: CoolJSONWrapperShowOffer{Json: []byte("not json")},
+				Time:    chron.NewYear(2020).Time,
+				Ptr1:    nil,
+				Ptr2:    stringPtr("not an id"),
+				Float:   1.5,
+				Kept:    "kept",
+			},
+			expected: map[string]interface{}{
+				"kept": "kept",
+			},
+		},
+		{
+			caseNum: 22,
+			name:    "It converts structs and maps to json subdocuments",
+			testStruct: struct {
+				Struct Nested                 `bsoncv:"struct,$json"`
+				Map    map[string]interface{} `bsoncv:"map,$json"`
+				NilMap map[string]int         `bsoncv:"nilMap,$json,omitempty"`
+			}{
+				Struct: Nested{ID: "0123456789abcdef01234567"},
+				Map: map[string]interface{}{
+					"text":  "This is a message",
+					"count": 2,
+					"meta":  map[string]bool{"read": true},
+				},
+				NilMap: nil,
+			},
+			expected: map[string]interface{}{
+				"struct": map[string]interface{}{"ID": "0123456789abcdef01234567"},
+				"map": map[string]interface{}{
+					"text":  "This is a message",
+					"count": float64(2),
+					"meta":  map[string]interface{}{"read": true},
+				},
+			},
+		},
+		{
+			caseNum: 23,
+			name:    "It converts the elements of slices and fixed size arrays",
+			testStruct: struct {
+				IDs       [2]string         `bsoncv:"ids,$oid"`
+				IDSlice   []string          `bsoncv:"idSlice,$oid"`
+				Dates     [1]int            `bsoncv:"dates,$date"`
+				Docs      [1]bsoncv.RawJSON `bsoncv:"docs,$json"`
+				UUID      [4]byte           `bsoncv:"uuid"`
+				Tags      []string          `bsoncv:"tags"`
+				NoIDs     []string          `bsoncv:"noIds,$oid,omitempty"`
+				JsonArray [7]byte           `bsoncv:"jsonArray,$json"`
+			}{
+				IDs:       [2]string{"0123456789abcdef01234567", "0123456789abcdef01234567"},
+				IDSlice:   []string{"0123456789abcdef01234567"},
+				Dates:     [1]int{0},
+				Docs:      [1]bsoncv.RawJSON{bsoncv.RawJSON(`{"a":1}`)},
+				UUID:      [4]byte{1, 2, 3, 4},
+				Tags:      []string{"one", "two"},
+				JsonArray: [7]byte{'[', '1', ',', '2', ',', '3', ']'},
+			},
+			expected: map[string]interface{}{
+				"ids":       []interface{}{objectId, objectId},
+				"idSlice":   []interface{}{objectId},
+				"dates":     []interface{}{time.Unix(0, 0)},
+				"docs":      []interface{}{map[string]interface{}{"a": float64(1)}},
+				"uuid":      [4]byte{1, 2, 3, 4},
+				"tags":      []string{"one", "two"},
+				"jsonArray": []interface{}{float64(1), float64(2), float64(3)},
+			},
+		},
 	}
 )
 
@@ -333,6 +586,1350 @@ func TestStructToMap(t *testing.T) {
 	}
 }
 
+// the field metadata is cached per type, converting the same types from many
+// goroutines at once must give the same results
+func TestStructToMapConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, c := range cases {
+				actual, err := bsoncv.StructToMap(c.testStruct)
+				if err != nil {
+					t.Errorf("%+v", err)
+				}
+				if !reflect.DeepEqual(c.expected, actual) {
+					t.Errorf("FAILED: caseNum:%v - %s\nexpected: %v\nactual:   %v\n", c.caseNum, c.name, c.expected, actual)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type benchUser struct {
+	ID        string    `bsoncv:"_id,$oid"`
+	Name      string    `json:"name"`
+	Email     string    `bson:"email"`
+	CreatedAt string    `bsoncv:"createdAt,$date,,RFC3339"`
+	Age       int       `bsoncv:"age,$int32,omitempty"`
+	Active    bool      `bsoncv:"active"`
+	Tags      []string  `bsoncv:"tags,,omitempty"`
+	Updated   time.Time `bsoncv:"updated"`
+}
+
+var benchDoc = benchUser{
+	ID:        "5e2b4b5b1f1c3e0a2c8b4567",
+	Name:      "name",
+	Email:     "name@example.com",
+	CreatedAt: "2020-01-24T19:30:03Z",
+	Age:       30,
+	Active:    true,
+	Tags:      []string{"one", "two"},
+	Updated:   time.Unix(1579894203, 0),
+}
+
+func BenchmarkStructToMap(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := bsoncv.StructToMap(benchDoc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkToBson(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := bsoncv.ToBson(benchDoc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendBSON(b *testing.B) {
+	b.ReportAllocs()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = bsoncv.AppendBSON(buf[:0], benchDoc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// AppendBSON writes the same document as ToBson
+func TestAppendBSON(t *testing.T) {
+	// decoded with the driver since ToBson's field order follows the map
+	decode := func(bsn []byte) bson.M {
+		var m bson.M
+		if err := bson.Unmarshal(bsn, &m); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return m
+	}
+	for _, c := range cases {
+		expected, err := bsoncv.ToBson(c.testStruct)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		actual, err := bsoncv.AppendBSON(nil, c.testStruct)
+		if err != nil {
+			t.Fatalf("caseNum:%v - %s: %+v", c.caseNum, c.name, err)
+		}
+		if expected == nil {
+			if actual != nil {
+				t.Errorf("FAILED: caseNum:%v - %s: expected nothing, got %s", c.caseNum, c.name, bsoncv.ToJson(actual))
+			}
+			continue
+		}
+		if !reflect.DeepEqual(decode(expected), decode(actual)) {
+			t.Errorf("FAILED: caseNum:%v - %s\nexpected: %s\nactual:   %s\n", c.caseNum, c.name, bsoncv.ToJson(expected), bsoncv.ToJson(actual))
+		}
+	}
+
+	type item struct {
+		SKU   string `bsoncv:"sku"`
+		Added string `bsoncv:"added,$date,,RFC3339"`
+	}
+	type order struct {
+		ID    string  `bsoncv:"_id,$oid"`
+		Items []item  `bsoncv:"items"`
+		Ship  *Nested `bsoncv:"ship"`
+	}
+	doc := order{
+		ID:    "5e2b4b5b1f1c3e0a2c8b4567",
+		Items: []item{{SKU: "a", Added: "2021-03-01T12:00:00Z"}},
+	}
+	prefix := []byte("prefix")
+	actual, err := bsoncv.AppendBSON(prefix, &doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.HasPrefix(actual, prefix) {
+		t.Error("expected the document to be appended to dst")
+	}
+	expected := `{"_id":"5e2b4b5b1f1c3e0a2c8b4567","items":[{"sku":"a","added":"2021-03-01T12:00:00Z"}],"ship":null}`
+	if string(bsoncv.ToJson(actual[len(prefix):])) != expected {
+		t.Errorf("expected the fields in struct order %s, got %s", expected, bsoncv.ToJson(actual[len(prefix):]))
+	}
+
+	var buf bytes.Buffer
+	if err := bsoncv.WriteBSON(&buf, doc); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), actual[len(prefix):]) {
+		t.Error("expected WriteBSON to write the same document")
+	}
+
+	var missing *order
+	if actual, err := bsoncv.AppendBSON(prefix, missing); err != nil || !bytes.Equal(actual, prefix) {
+		t.Errorf("expected nothing appended for a nil pointer, got %q %v", actual, err)
+	}
+	doc.Items[0].Added = "March"
+	if actual, err := bsoncv.AppendBSON(prefix, doc); err == nil || !strings.Contains(err.Error(), "for field items.0.added") || !bytes.Equal(actual, prefix) {
+		t.Errorf("expected an error naming items.0.added and dst unchanged, got %q %v", actual, err)
+	}
+}
+
+func TestStructToMapNilAsNull(t *testing.T) {
+	type pointers struct {
+		String *string     `bsoncv:"string"`
+		Oid    *string     `bsoncv:"oid,$oid"`
+		Int    *int        `bsoncv:"int"`
+		Date   *int        `bsoncv:"date,$date"`
+		Struct *Nested     `bsoncv:"struct"`
+		Slice  *[]string   `bsoncv:"slice"`
+		Time   *time.Time  `bsoncv:"time"`
+		Iface  interface{} `bsoncv:"iface"`
+		Omit   *string     `bsoncv:"omit,,omitempty"`
+	}
+	withNulls, err := bsoncv.StructToMapWithOptions(pointers{}, bsoncv.Options{NilAsNull: true})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"string": nil,
+		"oid":    nil,
+		"int":    nil,
+		"date":   nil,
+		"struct": nil,
+		"slice":  nil,
+		"time":   nil,
+		"iface":  nil,
+	}
+	if !reflect.DeepEqual(expected, withNulls) {
+		t.Errorf("NilAsNull: true\nexpected: %v\nactual:   %v", expected, withNulls)
+	}
+
+	withoutNulls, err := bsoncv.StructToMapWithOptions(pointers{}, bsoncv.Options{NilAsNull: false})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(withoutNulls) != 0 {
+		t.Errorf("NilAsNull: false\nexpected: map[]\nactual:   %v", withoutNulls)
+	}
+}
+
+func TestStructToMapOmitEmptyByDefault(t *testing.T) {
+	type sparse struct {
+		String  string            `bsoncv:"string"`
+		Int     int               `bsoncv:"int"`
+		Float   float64           `bsoncv:"float"`
+		Bool    bool              `bsoncv:"bool"`
+		Time    time.Time         `bsoncv:"time"`
+		Ptr     *string           `bsoncv:"ptr"`
+		Slice   []string          `bsoncv:"slice"`
+		Map     map[string]string `bsoncv:"map"`
+		Struct  Nested            `bsoncv:"struct"`
+		Oid     string            `bsoncv:"oid,$oid"`
+		Date    int               `bsoncv:"date,$date"`
+		Count   int               `bsoncv:"count,,keepempty"`
+		Deleted bool              `bsoncv:"deleted,$bool,keepempty"`
+		Name    string            `bsoncv:"name"`
+	}
+	actual, err := bsoncv.StructToMapWithOptions(sparse{
+		Slice: []string{},
+		Map:   map[string]string{},
+		Name:  "name",
+	}, bsoncv.Options{NilAsNull: true, OmitEmptyByDefault: true})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"count":   0,
+		"deleted": false,
+		"name":    "name",
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	// keepempty is the same as leaving the slot empty without the option
+	withoutOption, err := bsoncv.StructToMap(struct {
+		Count int `bsoncv:"count,,keepempty"`
+	}{})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(map[string]interface{}{"count": 0}, withoutOption) {
+		t.Errorf("expected count to be kept, got %v", withoutOption)
+	}
+}
+
+func TestStructToMapInterfaceFields(t *testing.T) {
+	type event struct {
+		Payload interface{} `bsoncv:"payload"`
+		ID      interface{} `bsoncv:"id,$oid"`
+		Empty   interface{} `bsoncv:"empty,,omitempty"`
+	}
+	for _, c := range []struct {
+		name     string
+		event    event
+		expected map[string]interface{}
+	}{
+		{
+			name:  "struct",
+			event: event{Payload: Nested{ID: "0123456789abcdef01234567"}, ID: "0123456789abcdef01234567"},
+			expected: map[string]interface{}{
+				"payload": map[string]interface{}{"_id": objectId},
+				"id":      objectId,
+			},
+		},
+		{
+			name:  "pointer to struct",
+			event: event{Payload: &Nested{ID: "0123456789abcdef01234567"}, ID: stringPtr("0123456789abcdef01234567")},
+			expected: map[string]interface{}{
+				"payload": map[string]interface{}{"_id": objectId},
+				"id":      objectId,
+			},
+		},
+		{
+			name:  "scalar",
+			event: event{Payload: 42, ID: nil},
+			expected: map[string]interface{}{
+				"payload": 42,
+				"id":      nil,
+			},
+		},
+	} {
+		actual, err := bsoncv.StructToMap(c.event)
+		if err != nil {
+			t.Fatalf("%s: %+v", c.name, err)
+		}
+		if !reflect.DeepEqual(c.expected, actual) {
+			t.Errorf("%s\nexpected: %v\nactual:   %v", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestStructToMapErrorPath(t *testing.T) {
+	type customer struct {
+		ID string `bsoncv:"_id,$oid"`
+	}
+	type order struct {
+		Customer *customer `bsoncv:"customer"`
+	}
+	_, err := bsoncv.StructToMap(struct {
+		Order order `bsoncv:"order"`
+	}{
+		Order: order{Customer: &customer{ID: "not an id"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "for field order.customer._id") {
+		t.Errorf("expected the error to name order.customer._id, got %v", err)
+	}
+}
+
+func TestJsonErrWrapper(t *testing.T) {
+	actual, err := bsoncv.StructToMap(struct {
+		Msg LazyJSON `bsoncv:"msg,$json"`
+	}{
+		Msg: LazyJSON{Json: []byte(`{"text":"This is a message"}`)},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"msg": map[string]interface{}{"text": "This is a message"},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	_, err = bsoncv.StructToMap(struct {
+		Msg LazyJSON `bsoncv:"msg,$json"`
+	}{
+		Msg: LazyJSON{Err: errors.New("upstream timed out")},
+	})
+	if err == nil || !strings.Contains(err.Error(), "upstream timed out") {
+		t.Errorf("expected the wrapper's error, got %v", err)
+	}
+}
+
+func TestArrayElementError(t *testing.T) {
+	_, err := bsoncv.StructToMap(struct {
+		IDs [2]string `bsoncv:"ids,$oid"`
+	}{
+		IDs: [2]string{"0123456789abcdef01234567", "not an id"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "element 1") || !strings.Contains(err.Error(), "for field ids") {
+		t.Errorf("expected the error to name element 1 of ids, got %v", err)
+	}
+}
+
+func TestJsonSyntaxErrorOffset(t *testing.T) {
+	_, err := bsoncv.StructToMap(struct {
+		Msg []byte `bsoncv:"msg,$json"`
+	}{
+		Msg: []byte(`{"text":"This is a message","meta":{"array":[0,1,"tw`),
+	})
+	if err == nil {
+		t.Fatal("expected an error for truncated json")
+	}
+	if !strings.Contains(err.Error(), "invalid json at offset 52 near") ||
+		!strings.Contains(err.Error(), `"array\":[0,1,\"tw"`) {
+		t.Errorf("expected the offset and surrounding bytes in the error, got %v", err)
+	}
+}
+
+// Money encodes itself as a decimal string
+type Money struct {
+	Cents int64
+}
+
+func (m Money) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(fmt.Sprintf("%d.%02d", m.Cents/100, m.Cents%100))
+}
+
+// Tags encodes itself as a subdocument with a pointer receiver
+type Tags struct {
+	Values []string
+}
+
+func (t *Tags) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(bson.D{{Key: "tags", Value: strings.Join(t.Values, " ")}})
+}
+
+func TestBsonMarshalerFields(t *testing.T) {
+	v := struct {
+		Price    Money  `bsoncv:"price"`
+		Discount *Money `bsoncv:"discount"`
+		Tags     Tags   `bsoncv:"tags"`
+	}{
+		Price:    Money{Cents: 1234},
+		Discount: &Money{Cents: 50},
+		Tags:     Tags{Values: []string{"a", "b"}},
+	}
+	actual, err := bsoncv.StructToMap(v)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"price":    Money{Cents: 1234},
+		"discount": Money{Cents: 50},
+		"tags":     &Tags{Values: []string{"a", "b"}},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	bsn, err := bsoncv.ToBson(struct {
+		Price Money `bsoncv:"price"`
+	}{
+		Price: Money{Cents: 1234},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if jsn := string(bsoncv.ToJson(bsn)); jsn != `{"price":"12.34"}` {
+		t.Errorf("expected MarshalBSONValue to be used, got %s", jsn)
+	}
+}
+
+func TestInlineMap(t *testing.T) {
+	type Doc struct {
+		ID    string                 `bson:"_id" bsoncv:"_id"`
+		Name  string                 `bson:"name" bsoncv:"name"`
+		Extra map[string]interface{} `bson:",inline" bsoncv:",inline"`
+	}
+	doc := Doc{ID: "1", Name: "one", Extra: map[string]interface{}{"color": "red", "size": int32(3)}}
+	actual, err := bsoncv.StructToMap(doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{"_id": "1", "name": "one", "color": "red", "size": int32(3)}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	// reading back, the driver puts the keys no field claims in the map
+	bsn, err := bsoncv.ToBson(doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var decoded Doc
+	if err := bson.Unmarshal(bsn, &decoded); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(doc, decoded) {
+		t.Errorf("expected: %v\nactual:   %v", doc, decoded)
+	}
+
+	doc.Extra["name"] = "two"
+	if _, err := bsoncv.StructToMap(doc); err == nil || !strings.Contains(err.Error(), "inline key name collides") {
+		t.Errorf("expected a collision error, got %v", err)
+	}
+	// a declared field collides even when omitempty leaves it out
+	if _, err := bsoncv.StructToMap(struct {
+		Name  string                 `bsoncv:"name,,omitempty"`
+		Extra map[string]interface{} `bsoncv:",inline"`
+	}{Extra: map[string]interface{}{"name": "two"}}); err == nil {
+		t.Error("expected a collision error for an omitted field")
+	}
+	if _, err := bsoncv.StructToMap(struct {
+		Extra []string `bsoncv:",inline"`
+	}{}); err == nil {
+		t.Error("expected an error for an inline field that isn't a map")
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	actual, err := bsoncv.StructToMap(struct {
+		Payload json.RawMessage `json:"payload"`
+		Array   json.RawMessage `json:"array"`
+		Raw     bsoncv.RawJSON  `json:"raw"`
+		Empty   json.RawMessage `json:"empty"`
+		Omitted json.RawMessage `bsoncv:"omitted,,omitempty"`
+	}{
+		Payload: json.RawMessage(`{"text":"This is a message","meta":{"read":true}}`),
+		Array:   json.RawMessage(`[1,"two"]`),
+		Raw:     bsoncv.RawJSON(`{"a":1}`),
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"payload": map[string]interface{}{
+			"text": "This is a message",
+			"meta": map[string]interface{}{"read": true},
+		},
+		"array": []interface{}{float64(1), "two"},
+		"raw":   map[string]interface{}{"a": float64(1)},
+		"empty": nil,
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+}
+
+func TestJsonUseNumber(t *testing.T) {
+	payload := []byte(`{"views":9007199254740993,"ratio":0.5,"exp":1e3,"huge":18446744073709551616,"counts":[1,-2]}`)
+	actual, err := bsoncv.StructToMapWithOptions(struct {
+		Payload []byte `bsoncv:"payload,$json"`
+	}{
+		Payload: payload,
+	}, bsoncv.Options{UseNumber: true})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"payload": map[string]interface{}{
+			"views":  int64(9007199254740993),
+			"ratio":  0.5,
+			"exp":    float64(1000),
+			"huge":   float64(18446744073709551616),
+			"counts": []interface{}{int64(1), int64(-2)},
+		},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	// without the option the counter loses precision as a float64
+	actual, err = bsoncv.StructToMap(struct {
+		Payload []byte `bsoncv:"payload,$json"`
+	}{
+		Payload: payload,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if views := actual["payload"].(map[string]interface{})["views"]; views != float64(9007199254740992) {
+		t.Errorf("expected a rounded float64, got %v", views)
+	}
+
+	for _, invalid := range []string{`{"views":1`, `{"views":1} {}`} {
+		_, err := bsoncv.StructToMapWithOptions(struct {
+			Payload []byte `bsoncv:"payload,$json"`
+		}{
+			Payload: []byte(invalid),
+		}, bsoncv.Options{UseNumber: true})
+		if err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestRawJSON(t *testing.T) {
+	type event struct {
+		Payload bsoncv.RawJSON `json:"payload" bsoncv:"payload,$json"`
+		Extra   bsoncv.RawJSON `json:"extra,omitempty" bsoncv:"extra,$json,omitempty"`
+	}
+	payload := `{"text":"This is a message","meta":{"count":2}}`
+	actual, err := bsoncv.StructToMap(event{Payload: bsoncv.RawJSON(payload)})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"payload": map[string]interface{}{
+			"text": "This is a message",
+			"meta": map[string]interface{}{"count": float64(2)},
+		},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	bsn, err := bsoncv.ToBson(event{Payload: bsoncv.RawJSON(payload)})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var decoded event
+	if err := json.Unmarshal(bsoncv.ToJson(bsn), &decoded); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if decoded.Extra != nil {
+		t.Errorf("expected the omitted field to stay nil, got %s", decoded.Extra)
+	}
+	var expectedPayload, actualPayload interface{}
+	if err := json.Unmarshal([]byte(payload), &expectedPayload); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(decoded.Payload, &actualPayload); err != nil {
+		t.Fatalf("expected raw json bytes, got %s: %v", decoded.Payload, err)
+	}
+	if !reflect.DeepEqual(expectedPayload, actualPayload) {
+		t.Errorf("expected: %v\nactual:   %v", expectedPayload, actualPayload)
+	}
+
+	jsn, err := json.Marshal(event{Payload: bsoncv.RawJSON(`[1,2]`)})
+	if err != nil || string(jsn) != `{"payload":[1,2]}` {
+		t.Errorf("expected the raw json to be marshalled as is, got %s %v", jsn, err)
+	}
+}
+
+func init() {
+	// builds a GeoJSON point from a "lat,lng" string
+	bsoncv.RegisterConversion("$latlng", func(v reflect.Value, tag bsoncv.ConvTag) (interface{}, error) {
+		parts := strings.Split(v.String(), ",")
+		if len(parts) != 2 {
+			return nil, errors.New("expected lat,lng")
+		}
+		lat, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		lng, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "Point", "coordinates": []float64{lng, lat}}, nil
+	})
+}
+
+func TestRegisterConversion(t *testing.T) {
+	actual, err := bsoncv.StructToMap(struct {
+		Location string  `bsoncv:"location,$latlng"`
+		Pointer  *string `bsoncv:"pointer,$latlng"`
+		Empty    string  `bsoncv:"empty,$latlng,omitempty"`
+		NilPtr   *string `bsoncv:"nilPtr,$latlng,omitempty"`
+		Unknown  string  `bsoncv:"unknown,$notregistered"`
+	}{
+		Location: "40.5,-74.25",
+		Pointer:  stringPtr("1,2"),
+		Unknown:  "as is",
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"location": map[string]interface{}{"type": "Point", "coordinates": []float64{-74.25, 40.5}},
+		"pointer":  map[string]interface{}{"type": "Point", "coordinates": []float64{2, 1}},
+		"unknown":  "as is",
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	_, err = bsoncv.StructToMap(struct {
+		Location string `bsoncv:"location,$latlng"`
+	}{
+		Location: "north",
+	})
+	if err == nil || !strings.Contains(err.Error(), "to $latlng for field location") {
+		t.Errorf("expected the conversion's error, got %v", err)
+	}
+
+	for _, name := range []string{"$latlng", "$oid", ""} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected registering %q to panic", name)
+				}
+			}()
+			bsoncv.RegisterConversion(name, func(v reflect.Value, tag bsoncv.ConvTag) (interface{}, error) {
+				return nil, nil
+			})
+		}()
+	}
+}
+
+func TestPointConversion(t *testing.T) {
+	type coords struct {
+		Lat float64
+		Lng float64
+	}
+	actual, err := bsoncv.StructToMap(struct {
+		String  string  `bsoncv:"string,$point"`
+		Struct  coords  `bsoncv:"struct,$point"`
+		Pointer *coords `bsoncv:"pointer,$point,omitempty"`
+		Empty   string  `bsoncv:"empty,$point,omitempty"`
+	}{
+		String: "-73.97, 40.77",
+		Struct: coords{Lat: -33.86, Lng: 151.21},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"string": map[string]interface{}{"type": "Point", "coordinates": []float64{-73.97, 40.77}},
+		"struct": map[string]interface{}{"type": "Point", "coordinates": []float64{151.21, -33.86}},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	for _, c := range []struct {
+		point    interface{}
+		expected string
+	}{
+		{struct {
+			P string `bsoncv:"p,$point"`
+		}{"181,0"}, "longitude 181 is outside [-180, 180]"},
+		{struct {
+			P string `bsoncv:"p,$point"`
+		}{"0,-90.5"}, "latitude -90.5 is outside [-90, 90]"},
+		{struct {
+			P coords `bsoncv:"p,$point"`
+		}{coords{Lat: 91}}, "latitude 91 is outside [-90, 90]"},
+		{struct {
+			P string `bsoncv:"p,$point"`
+		}{"40.77"}, "isn't formatted lng,lat"},
+		{struct {
+			P string `bsoncv:"p,$point"`
+		}{"west,40"}, "invalid longitude"},
+		{struct {
+			P int `bsoncv:"p,$point"`
+		}{1}, "can't convert int to a point"},
+	} {
+		_, err := bsoncv.StructToMap(c.point)
+		if err == nil || !strings.Contains(err.Error(), c.expected) || !strings.Contains(err.Error(), "for field p") {
+			t.Errorf("expected an error containing %q, got %v", c.expected, err)
+		}
+	}
+}
+
+func TestDateRangeConversion(t *testing.T) {
+	type period struct {
+		From time.Time
+		To   time.Time
+	}
+	jan, feb := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	actual, err := bsoncv.StructToMap(struct {
+		Array   [2]time.Time `bsoncv:"array,$daterange"`
+		Struct  period       `bsoncv:"struct,$daterange"`
+		Pointer *period      `bsoncv:"pointer,$daterange,omitempty"`
+		Same    [2]time.Time `bsoncv:"same,$daterange"`
+		Empty   [2]time.Time `bsoncv:"empty,$daterange,omitempty"`
+	}{
+		Array:  [2]time.Time{jan, feb},
+		Struct: period{From: jan, To: feb},
+		Same:   [2]time.Time{jan, jan},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"array":  map[string]interface{}{"from": jan, "to": feb},
+		"struct": map[string]interface{}{"from": jan, "to": feb},
+		"same":   map[string]interface{}{"from": jan, "to": jan},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	for _, c := range []struct {
+		dateRange interface{}
+		expected  string
+	}{
+		{struct {
+			R [2]time.Time `bsoncv:"r,$daterange"`
+		}{[2]time.Time{feb, jan}}, "range from 2021-02-01T00:00:00Z is after to 2021-01-01T00:00:00Z"},
+		{struct {
+			R period `bsoncv:"r,$daterange"`
+		}{period{From: feb, To: jan}}, "is after to"},
+		{struct {
+			R struct{ Start time.Time } `bsoncv:"r,$daterange"`
+		}{}, "has no time.Time From and To fields"},
+		{struct {
+			R string `bsoncv:"r,$daterange"`
+		}{"2021"}, "can't convert string to a date range"},
+	} {
+		_, err := bsoncv.StructToMap(c.dateRange)
+		if err == nil || !strings.Contains(err.Error(), c.expected) || !strings.Contains(err.Error(), "for field r") {
+			t.Errorf("expected an error containing %q, got %v", c.expected, err)
+		}
+	}
+}
+
+func TestSliceOfStructs(t *testing.T) {
+	type lineItem struct {
+		SKU     string    `bsoncv:"sku"`
+		Shipped string    `bsoncv:"shipped,$date,omitempty,RFC3339"`
+		Added   time.Time `bsoncv:"added"`
+	}
+	added := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	actual, err := bsoncv.StructToMap(struct {
+		Items    []lineItem  `bsoncv:"items"`
+		Pointers []*lineItem `bsoncv:"pointers"`
+		Empty    []lineItem  `bsoncv:"empty,,omitempty"`
+	}{
+		Items: []lineItem{
+			{SKU: "a", Shipped: "2021-03-02T08:00:00Z", Added: added},
+			{SKU: "b", Added: added.Add(time.Hour)},
+		},
+		Pointers: []*lineItem{{SKU: "c", Added: added}, nil},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"items": []map[string]interface{}{
+			{"sku": "a", "shipped": time.Date(2021, 3, 2, 8, 0, 0, 0, time.UTC), "added": added},
+			{"sku": "b", "added": added.Add(time.Hour)},
+		},
+		"pointers": []map[string]interface{}{
+			{"sku": "c", "added": added},
+			nil,
+		},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	_, err = bsoncv.StructToMap(struct {
+		Items []lineItem `bsoncv:"items"`
+	}{[]lineItem{{SKU: "a"}, {SKU: "b", Shipped: "March"}}})
+	if err == nil || !strings.Contains(err.Error(), "for field items.1.shipped") {
+		t.Errorf("expected an error naming items.1.shipped, got %v", err)
+	}
+}
+
+func TestTimestampConversion(t *testing.T) {
+	type clock struct {
+		T, I uint32
+	}
+	actual, err := bsoncv.StructToMap(struct {
+		Seconds   int64               `bsoncv:"seconds,$timestamp"`
+		Unsigned  uint32              `bsoncv:"unsigned,$timestamp"`
+		String    string              `bsoncv:"string,$timestamp"`
+		Time      time.Time           `bsoncv:"time,$timestamp"`
+		Explicit  clock               `bsoncv:"explicit,$timestamp"`
+		Primitive primitive.Timestamp `bsoncv:"primitive,$timestamp"`
+		Empty     int64               `bsoncv:"empty,$timestamp,omitempty"`
+	}{
+		Seconds:   1578915133,
+		Unsigned:  1578915134,
+		String:    "2020-01-13T11:32:15Z",
+		Time:      time.Unix(1578915136, 500),
+		Explicit:  clock{T: 1578915137, I: 3},
+		Primitive: primitive.Timestamp{T: 1578915138, I: 4},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"seconds":   primitive.Timestamp{T: 1578915133},
+		"unsigned":  primitive.Timestamp{T: 1578915134},
+		"string":    primitive.Timestamp{T: 1578915135},
+		"time":      primitive.Timestamp{T: 1578915136},
+		"explicit":  primitive.Timestamp{T: 1578915137, I: 3},
+		"primitive": primitive.Timestamp{T: 1578915138, I: 4},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	for _, c := range []struct {
+		timestamp interface{}
+		expected  string
+	}{
+		{struct {
+			TS int64 `bsoncv:"ts,$timestamp"`
+		}{-1}, "-1 seconds is outside a timestamp's range"},
+		{struct {
+			TS int64 `bsoncv:"ts,$timestamp"`
+		}{math.MaxUint32 + 1}, "is outside a timestamp's range"},
+		{struct {
+			TS string `bsoncv:"ts,$timestamp"`
+		}{"yesterday"}, "invalid timestamp"},
+		{struct {
+			TS struct{ T int } `bsoncv:"ts,$timestamp"`
+		}{}, "has no integer T and I fields"},
+		{struct {
+			TS struct{ T, I int64 } `bsoncv:"ts,$timestamp"`
+		}{struct{ T, I int64 }{T: -5}}, "T -5 is outside"},
+		{struct {
+			TS float64 `bsoncv:"ts,$timestamp"`
+		}{1.5}, "can't convert float64 to a timestamp"},
+	} {
+		_, err := bsoncv.StructToMap(c.timestamp)
+		if err == nil || !strings.Contains(err.Error(), c.expected) || !strings.Contains(err.Error(), "for field ts") {
+			t.Errorf("expected an error containing %q, got %v", c.expected, err)
+		}
+	}
+}
+
+type treeNode struct {
+	Name     string      `bsoncv:"name"`
+	Parent   *treeNode   `bsoncv:"parent,,omitempty"`
+	Children []*treeNode `bsoncv:"children,,omitempty"`
+}
+
+func TestCycles(t *testing.T) {
+	self := &treeNode{Name: "self"}
+	self.Parent = self
+	root := &treeNode{Name: "root"}
+	child := &treeNode{Name: "child", Parent: root}
+	root.Children = []*treeNode{child}
+	for _, c := range []struct {
+		v        interface{}
+		expected string
+	}{
+		{self, "bsoncv field parent refers back to a bsoncv_test.treeNode it's nested in"},
+		{*self, "bsoncv field parent.parent refers back"},
+		{root, "bsoncv field children.0.parent refers back"},
+		{struct {
+			Node treeNode `bsoncv:"node"`
+		}{*child}, "bsoncv field node.parent.children.0.parent refers back"},
+	} {
+		if _, err := bsoncv.StructToMap(c.v); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("expected an error containing %q, got %v", c.expected, err)
+		}
+		if _, err := bsoncv.AppendBSON(nil, c.v); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("expected AppendBSON to return an error containing %q, got %v", c.expected, err)
+		}
+	}
+
+	// the same struct twice isn't a cycle
+	shared := &treeNode{Name: "shared"}
+	actual, err := bsoncv.StructToMap(struct {
+		A *treeNode `bsoncv:"a"`
+		B *treeNode `bsoncv:"b"`
+	}{shared, shared})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"a": map[string]interface{}{"name": "shared"},
+		"b": map[string]interface{}{"name": "shared"},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+}
+
+func TestDefaultDateLocation(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC-7", -7*60*60)
+	bsoncv.DefaultDateLocation = time.UTC
+	defer func() {
+		time.Local = local
+		bsoncv.DefaultDateLocation = nil
+	}()
+
+	expected := chron.NewMilli(2020, time.January, 13, 11, 32, 13, 222).Time.UTC()
+	actual, err := bsoncv.StructToMap(struct {
+		Date1 int    `bsoncv:"date1,$date"`
+		Date2 string `bsoncv:"date2,$date,,RFC3339"`
+	}{
+		Date1: int(expected.UnixNano() / int64(time.Millisecond)),
+		Date2: expected.In(time.Local).Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, key := range []string{"date1", "date2"} {
+		date, ok := actual[key].(time.Time)
+		if !ok {
+			t.Fatalf("expected %s to be a time.Time, got %T", key, actual[key])
+		}
+		if date.Location() != time.UTC || !date.Equal(expected) {
+			t.Errorf("expected %s to be %v, got %v", key, expected, date)
+		}
+	}
+}
+
+func TestDateLocationTag(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("tzdata unavailable:", err)
+	}
+	actual, err := bsoncv.StructToMap(struct {
+		Date string `bsoncv:"date,$date,,2006-01-02 15:04,America/New_York"`
+	}{
+		Date: "2020-01-13 11:32",
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := time.Date(2020, time.January, 13, 11, 32, 0, 0, newYork)
+	if date, ok := actual["date"].(time.Time); !ok || !date.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, actual["date"])
+	}
+
+	_, err = bsoncv.StructToMap(struct {
+		Date string `bsoncv:"date,$date,,2006-01-02 15:04,Not/A_Place"`
+	}{
+		Date: "2020-01-13 11:32",
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown location Not/A_Place") {
+		t.Errorf("expected an unknown location error, got %v", err)
+	}
+}
+
+func TestInt32Overflow(t *testing.T) {
+	for _, v := range []interface{}{
+		struct {
+			Count int64 `bsoncv:"count,$int32"`
+		}{Count: math.MaxInt32 + 1},
+		struct {
+			Count int64 `bsoncv:"count,$int32"`
+		}{Count: math.MinInt32 - 1},
+		struct {
+			Count uint32 `bsoncv:"count,$int32"`
+		}{Count: math.MaxUint32},
+	} {
+		if _, err := bsoncv.StructToMap(v); err == nil || !strings.Contains(err.Error(), "overflows int32") {
+			t.Errorf("expected an int32 overflow error for %+v, got %v", v, err)
+		}
+	}
+}
+
+func TestBoolConversionError(t *testing.T) {
+	_, err := bsoncv.StructToMap(struct {
+		Flag string `bsoncv:"flag,$bool"`
+	}{Flag: "maybe"})
+	if err == nil || !strings.Contains(err.Error(), "|maybe| to $bool for field flag") {
+		t.Errorf("expected a $bool conversion error, got %v", err)
+	}
+}
+
+func TestMoneyConversion(t *testing.T) {
+	actual, err := bsoncv.StructToMap(struct {
+		Price    int64   `bsoncv:"price,$money"`
+		Refund   int     `bsoncv:"refund,$money,,2"`
+		Rate     int32   `bsoncv:"rate,$money,,4"`
+		Whole    uint    `bsoncv:"whole,$money,,0"`
+		Tiny     int     `bsoncv:"tiny,$money,,3"`
+		Empty    int     `bsoncv:"empty,$money,omitempty"`
+		Payments []int64 `bsoncv:"payments,$money"`
+	}{
+		Price:    12345,
+		Refund:   -5,
+		Rate:     12500,
+		Whole:    100,
+		Tiny:     7,
+		Payments: []int64{100, -250},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]string{
+		"price":  "123.45",
+		"refund": "-0.05",
+		"rate":   "1.2500",
+		"whole":  "100",
+		"tiny":   "0.007",
+	}
+	for name, str := range expected {
+		d, ok := actual[name].(primitive.Decimal128)
+		if !ok || d.String() != str {
+			t.Errorf("expected %s to be Decimal128 %s, got %T %v", name, str, actual[name], actual[name])
+		}
+	}
+	if _, ok := actual["empty"]; ok {
+		t.Error("expected a zero amount to be omitted")
+	}
+	payments, _ := actual["payments"].([]interface{})
+	if len(payments) != 2 || payments[0].(primitive.Decimal128).String() != "1.00" || payments[1].(primitive.Decimal128).String() != "-2.50" {
+		t.Errorf("unexpected payments %v", actual["payments"])
+	}
+
+	bsn, err := bsoncv.ToBson(struct {
+		Price int64 `bsoncv:"price,$money"`
+	}{Price: 12345})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if json := string(bsoncv.ToJson(bsn)); json != `{"price":"123.45"}` {
+		t.Errorf("expected the amount as a string, got %s", json)
+	}
+	if json := string(bsoncv.ToExtendedJson(bsn)); json != `{"price":{"$numberDecimal":"123.45"}}` {
+		t.Errorf("expected the amount as $numberDecimal, got %s", json)
+	}
+
+	_, err = bsoncv.StructToMap(struct {
+		Price int64 `bsoncv:"price,$money,,cents"`
+	}{Price: 1})
+	if err == nil || !strings.Contains(err.Error(), "invalid $money scale") {
+		t.Errorf("expected a scale error, got %v", err)
+	}
+}
+
+func TestTagWhitespace(t *testing.T) {
+	actual, err := bsoncv.StructToMap(struct {
+		ID     string `bsoncv:"_id, $oid"`
+		Linked string `bsoncv:"linked, $oid, omitempty"`
+		Date   string `bsoncv:"date, $date, , DateOnly"`
+		Count  int    `bsoncv:" count , $int32 "`
+	}{
+		ID:    objectId.Hex(),
+		Date:  "2021-03-04",
+		Count: 3,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"_id":   objectId,
+		"date":  time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC),
+		"count": int32(3),
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+}
+
+func TestStrictUnknownConversion(t *testing.T) {
+	v := struct {
+		ID string `bsoncv:"_id,$objectid"`
+	}{ID: objectId.Hex()}
+
+	actual, err := bsoncv.StructToMap(v)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if actual["_id"] != objectId.Hex() {
+		t.Errorf("expected the field to be left as is, got %v", actual["_id"])
+	}
+
+	_, err = bsoncv.StructToMapWithOptions(v, bsoncv.Options{Strict: true})
+	if err == nil || !strings.Contains(err.Error(), "unknown conversion $objectid for field _id") {
+		t.Errorf("expected an unknown conversion error, got %v", err)
+	}
+
+	// known, registered and empty conversions are fine
+	if _, err := bsoncv.StructToMapWithOptions(struct {
+		ID     string `bsoncv:"_id,$oid"`
+		LatLng string `bsoncv:"latlng,$latlng,omitempty"`
+		Name   string `bsoncv:"name,,omitempty"`
+	}{ID: objectId.Hex()}, bsoncv.Options{Strict: true}); err != nil {
+		t.Errorf("unexpected error %+v", err)
+	}
+}
+
+func TestBinary(t *testing.T) {
+	type Hash []byte
+	uuid := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	actual, err := bsoncv.StructToMap(struct {
+		Data   []byte   `bsoncv:"data"`
+		Hash   Hash     `bsoncv:"hash"`
+		Nil    []byte   `bsoncv:"nil"`
+		Empty  []byte   `bsoncv:"empty,,omitempty"`
+		Token  [16]byte `bsoncv:"token,$binary,,uuid"`
+		Custom []byte   `bsoncv:"custom,$binary,,0x80"`
+	}{
+		Data:   []byte{0xff, 0x00, 'a'},
+		Hash:   Hash{1, 2},
+		Empty:  []byte{},
+		Token:  uuid,
+		Custom: []byte("not json"),
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"data":   primitive.Binary{Subtype: 0x00, Data: []byte{0xff, 0x00, 'a'}},
+		"hash":   primitive.Binary{Subtype: 0x00, Data: []byte{1, 2}},
+		"nil":    []byte(nil),
+		"token":  primitive.Binary{Subtype: 0x04, Data: uuid[:]},
+		"custom": primitive.Binary{Subtype: 0x80, Data: []byte("not json")},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	_, err = bsoncv.StructToMap(struct {
+		Token []byte `bsoncv:"token,$binary,,uuid"`
+	}{Token: []byte{1, 2, 3}})
+	if err == nil || !strings.Contains(err.Error(), "a uuid must be 16 bytes") {
+		t.Errorf("expected a uuid length error, got %v", err)
+	}
+}
+
+func TestObjectIDNotBinary(t *testing.T) {
+	doc := struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}{ID: objectId}
+
+	m, err := bsoncv.StructToMap(doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if m["_id"] != objectId {
+		t.Errorf("StructToMap: expected the ObjectID, got %#v", m["_id"])
+	}
+
+	bsn, err := bsoncv.ToBson(doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	appended, err := bsoncv.AppendBSON(nil, doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for name, b := range map[string][]byte{"ToBson": bsn, "AppendBSON": appended} {
+		id, ok := bson.Raw(b).Lookup("_id").ObjectIDOK()
+		if !ok || id != objectId {
+			t.Errorf("%s: expected the ObjectID, got %s", name, bsoncv.ToExtendedJson(b))
+		}
+	}
+}
+
+func TestOmitEmptyFloats(t *testing.T) {
+	type Prices struct {
+		Delta   float64 `bsoncv:"delta,,omitempty"`
+		Delta32 float32 `bsoncv:"delta32,,omitempty"`
+		Kept    float64 `bsoncv:"kept"`
+		Price   float64 `bsoncv:"price,,omitempty"`
+		Price32 float32 `bsoncv:"price32,,omitempty"`
+		Neg     float64 `bsoncv:"neg,,omitempty"`
+		NegZero float64 `bsoncv:"negZero,,omitempty"`
+	}
+	actual, err := bsoncv.StructToMap(Prices{Price: 1.5, Price32: 2.5, Neg: -0.25, NegZero: math.Copysign(0, -1)})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"kept":    float64(0),
+		"price":   1.5,
+		"price32": float32(2.5),
+		"neg":     -0.25,
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+}
+
+func TestOmitEmptyBools(t *testing.T) {
+	type Flags struct {
+		Beta      bool `bsoncv:"beta,,omitempty"`
+		Dark      bool `bsoncv:"dark,,omitempty"`
+		Converted bool `bsoncv:"converted,$bool,omitempty"`
+		Kept      bool `bsoncv:"kept"`
+	}
+	actual, err := bsoncv.StructToMap(Flags{Dark: true})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{"dark": true, "kept": false}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+}
+
+func TestOmitEmptyInts(t *testing.T) {
+	type Counts struct {
+		Views   int    `bsoncv:"views,,omitempty"`
+		Likes   int64  `bsoncv:"likes,,omitempty"`
+		Shares  uint   `bsoncv:"shares,,omitempty"`
+		Date    int64  `bsoncv:"date,$date,omitempty"`
+		Unknown int    `bsoncv:"unknown,$oid,omitempty"`
+		Kept    int    `bsoncv:"kept"`
+		Clicks  int    `bsoncv:"clicks,,omitempty"`
+		Bytes   uint32 `bsoncv:"bytes,,omitempty"`
+	}
+	actual, err := bsoncv.StructToMap(Counts{Clicks: 3, Bytes: 4})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{"kept": 0, "clicks": 3, "bytes": uint32(4)}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+}
+
+func TestDurationConversion(t *testing.T) {
+	actual, err := bsoncv.StructToMap(struct {
+		Nanos    time.Duration   `bsoncv:"nanos,$duration"`
+		Millis   time.Duration   `bsoncv:"millis,$duration,,ms"`
+		Seconds  time.Duration   `bsoncv:"seconds,$duration,,s"`
+		Parsed   string          `bsoncv:"parsed,$duration,,ms"`
+		Empty    time.Duration   `bsoncv:"empty,$duration,omitempty,ms"`
+		Timeouts []time.Duration `bsoncv:"timeouts,$duration,,ms"`
+		Plain    time.Duration   `bsoncv:"plain"`
+	}{
+		Nanos:    1500 * time.Microsecond,
+		Millis:   1500*time.Millisecond + 999*time.Microsecond,
+		Seconds:  -90 * time.Second,
+		Parsed:   "1h30m",
+		Timeouts: []time.Duration{time.Second, 250 * time.Millisecond},
+		Plain:    time.Second,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]interface{}{
+		"nanos":    int64(1500000),
+		"millis":   int64(1500),
+		"seconds":  int64(-90),
+		"parsed":   int64(5400000),
+		"timeouts": []interface{}{int64(1000), int64(250)},
+		"plain":    time.Second,
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual:   %v", expected, actual)
+	}
+
+	_, err = bsoncv.StructToMap(struct {
+		TTL time.Duration `bsoncv:"ttl,$duration,,days"`
+	}{TTL: time.Hour})
+	if err == nil || !strings.Contains(err.Error(), "unknown $duration unit") {
+		t.Errorf("expected a unit error, got %v", err)
+	}
+}
+
+func TestStrictUnsupportedKinds(t *testing.T) {
+	cases := []struct {
+		name string
+		v    interface{}
+		err  string
+	}{
+		{"chan", struct {
+			Events chan int `bsoncv:"events"`
+		}{Events: make(chan int)}, "field events of kind chan"},
+		{"func", struct {
+			OnSave func() `bsoncv:"onSave"`
+		}{OnSave: func() {}}, "field onSave of kind func"},
+		{"complex", struct {
+			Nested struct {
+				Z complex128 `bsoncv:"z"`
+			} `bsoncv:"nested"`
+		}{}, "field nested.z of kind complex128"},
+	}
+	for _, c := range cases {
+		_, err := bsoncv.StructToMapWithOptions(c.v, bsoncv.Options{Strict: true})
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error naming %q, got %v", c.name, c.err, err)
+		}
+		if _, err := bsoncv.StructToMap(c.v); err != nil {
+			t.Errorf("%s: expected no error without Strict, got %v", c.name, err)
+		}
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	type binaryDoc struct {
+		Data  []byte `bsoncv:"data" json:"data"`
+		Empty []byte `bsoncv:"empty" json:"empty"`
+	}
+	written := binaryDoc{Data: []byte{0xff, 0x00, 'a', '"'}, Empty: []byte{}}
+	bsn, err := bsoncv.ToBson(written)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := bsoncv.ValidateBson(bsn); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var read binaryDoc
+	if err := json.Unmarshal(bsoncv.ToJson(bsn), &read); err != nil {
+		t.Fatalf("%v: %s", err, bsoncv.ToJson(bsn))
+	}
+	if !reflect.DeepEqual(written, read) {
+		t.Errorf("expected: %v\nactual:   %v", written, read)
+	}
+
+	extended := string(bsoncv.ToExtendedJson(bsn))
+	for _, expected := range []string{
+		`"data":{"$binary":{"base64":"/wBhIg==","subType":"00"}}`,
+		`"empty":{"$binary":{"base64":"","subType":"00"}}`,
+	} {
+		if !strings.Contains(extended, expected) {
+			t.Errorf("expected %s in %s", expected, extended)
+		}
+	}
+	var raw bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(extended), true, &raw); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(raw, bsn) {
+		t.Errorf("extended json didn't read back to the same bson")
+	}
+}
+
 func TestToBson(t *testing.T) {
 	for _, c := range cases {
 		bsn, err := bsoncv.ToBson(c.testStruct)
@@ -348,6 +1945,61 @@ func TestToBson(t *testing.T) {
 	}
 }
 
+func TestStructToMapPointer(t *testing.T) {
+	doc := Nested{ID: "5e2b4b5b1f1c3e0a2c8b4567"}
+	expected, err := bsoncv.StructToMap(doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	actual, err := bsoncv.StructToMap(&doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected &doc to convert like doc\nexpected: %v\nactual:   %v", expected, actual)
+	}
+	bsn, err := bsoncv.ToBson(&doc)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if string(bsoncv.ToJson(bsn)) != `{"_id":"5e2b4b5b1f1c3e0a2c8b4567"}` {
+		t.Errorf("unexpected bson %s", bsoncv.ToJson(bsn))
+	}
+
+	var missing *Nested
+	if m, err := bsoncv.StructToMap(missing); m != nil || err != nil {
+		t.Errorf("expected nil, nil for a nil pointer, got %v %v", m, err)
+	}
+	if bsn, err := bsoncv.ToBson(missing); bsn != nil || err != nil {
+		t.Errorf("expected nil, nil for a nil pointer, got %v %v", bsn, err)
+	}
+
+	n := 5
+	if _, err := bsoncv.StructToMap(&n); err == nil || err.Error() != "bsoncv: StructToMap requires a struct, got *int" {
+		t.Errorf("expected an error for a pointer to an int, got %v", err)
+	}
+}
+
+func TestStructToMapNonStruct(t *testing.T) {
+	for _, c := range []struct {
+		v        interface{}
+		expected string
+	}{
+		{v: 5, expected: "int"},
+		{v: "doc", expected: "string"},
+		{v: []Nested{{ID: "5e2b4b5b1f1c3e0a2c8b4567"}}, expected: "[]bsoncv_test.Nested"},
+		{v: map[string]interface{}{"_id": "1"}, expected: "map[string]interface {}"},
+	} {
+		m, err := bsoncv.StructToMap(c.v)
+		if err == nil || err.Error() != "bsoncv: StructToMap requires a struct, got "+c.expected {
+			t.Errorf("expected an error naming %s, got %v %v", c.expected, m, err)
+		}
+		if _, err := bsoncv.ToBson(c.v); err == nil {
+			t.Errorf("expected ToBson to return an error for %s", c.expected)
+		}
+	}
+}
+
 type CoolJSONWrapperShowOffer struct {
 	Json []byte
 }
@@ -356,6 +2008,20 @@ func (c CoolJSONWrapperShowOffer) JsonBytes() []byte {
 	return c.Json
 }
 
+// LazyJSON prefers JsonBytesErr over JsonBytes
+type LazyJSON struct {
+	Json []byte
+	Err  error
+}
+
+func (l LazyJSON) JsonBytes() []byte {
+	panic("JsonBytesErr should be used")
+}
+
+func (l LazyJSON) JsonBytesErr() ([]byte, error) {
+	return l.Json, l.Err
+}
+
 type Nested struct {
 	ID string `bsoncv:"_id,$oid"`
 }
@@ -367,3 +2033,7 @@ func stringPtr(s string) *string {
 func intPtr(i int) *int {
 	return &i
 }
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
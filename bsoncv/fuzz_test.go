@@ -0,0 +1,203 @@
+//go:build go1.18
+// +build go1.18
+
+package bsoncv_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/dustinevan/mongo/bsoncv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// FuzzToExtendedJson builds documents from the fuzz input, marshals them with
+// the driver and checks ToExtendedJson parses to the same values as the
+// driver's relaxed Extended JSON.
+//
+//	go test ./bsoncv -run '^$' -fuzz FuzzToExtendedJson
+func FuzzToExtendedJson(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{3, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	f.Add([]byte{4, 2, 3, 1, 10, 0xff, 0xff, 0xff, 0xff, 12, 0x80, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{2, 1, 5, '\n', '"', 0x01, '\\', 'x', 4, 3, 2, 9, 1, 8, 7, 6, 5})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		doc := (&docGen{data: data}).doc(0)
+		bsn, err := bson.Marshal(doc)
+		if err != nil {
+			t.Skip(err)
+		}
+		ext, err := bson.MarshalExtJSON(doc, false, false)
+		if err != nil {
+			t.Skip(err)
+		}
+		actual := bsoncv.ToExtendedJson(bsn)
+		if normalized(t, actual) != normalized(t, ext) {
+			t.Errorf("ToExtendedJson doesn't match the driver\ndriver: %s\nactual: %s", ext, actual)
+		}
+	})
+}
+
+// docGen reads documents out of fuzz input. Doubles are finite because json
+// has no NaN or Inf.
+type docGen struct {
+	data []byte
+}
+
+func (g *docGen) next(n int) []byte {
+	b := make([]byte, n)
+	copy(b, g.data)
+	if n > len(g.data) {
+		n = len(g.data)
+	}
+	g.data = g.data[n:]
+	return b
+}
+
+func (g *docGen) byte() byte {
+	return g.next(1)[0]
+}
+
+// cstring reads up to 15 bytes as valid UTF-8 without nulls, which bson
+// requires of keys and regexes
+func (g *docGen) cstring() string {
+	return string(bytes.ToValidUTF8(bytes.ReplaceAll(g.next(int(g.byte()%16)), []byte{0}, nil), nil))
+}
+
+func (g *docGen) doc(depth int) bson.D {
+	doc := bson.D{}
+	for i := 0; i < int(g.byte()%5); i++ {
+		doc = append(doc, bson.E{Key: g.cstring(), Value: g.value(depth)})
+	}
+	return doc
+}
+
+func (g *docGen) value(depth int) interface{} {
+	switch g.byte() % 17 {
+	case 0:
+		f := math.Float64frombits(binary.LittleEndian.Uint64(g.next(8)))
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0.5
+		}
+		return f
+	case 1:
+		return g.cstring()
+	case 2:
+		if depth > 4 {
+			return nil
+		}
+		return g.doc(depth + 1)
+	case 3:
+		if depth > 4 {
+			return nil
+		}
+		a := bson.A{}
+		for i := 0; i < int(g.byte()%5); i++ {
+			a = append(a, g.value(depth+1))
+		}
+		return a
+	case 4:
+		var oid primitive.ObjectID
+		copy(oid[:], g.next(12))
+		return oid
+	case 5:
+		return g.byte()%2 == 0
+	case 6:
+		// keep dates within the range time.Time can format
+		millis := int64(binary.LittleEndian.Uint64(g.next(8))) % (250000 * 365 * 24 * 3600 * 1000)
+		return primitive.DateTime(millis)
+	case 7:
+		return nil
+	case 8:
+		return int32(binary.LittleEndian.Uint32(g.next(4)))
+	case 9:
+		return primitive.Timestamp{T: binary.LittleEndian.Uint32(g.next(4)), I: binary.LittleEndian.Uint32(g.next(4))}
+	case 10:
+		return int64(binary.LittleEndian.Uint64(g.next(8)))
+	case 11:
+		return primitive.Binary{Subtype: g.byte(), Data: g.next(int(g.byte() % 16))}
+	case 12:
+		// only the flags mongo knows, the driver doesn't escape options
+		var options []byte
+		flags := g.byte()
+		for i, flag := range []byte("ilmsux") {
+			if flags&(1<<i) != 0 {
+				options = append(options, flag)
+			}
+		}
+		return primitive.Regex{Pattern: g.cstring(), Options: string(options)}
+	case 13:
+		return primitive.JavaScript(g.cstring())
+	case 14:
+		return primitive.MinKey{}
+	case 15:
+		return primitive.MaxKey{}
+	default:
+		b := g.next(16)
+		return primitive.NewDecimal128(binary.LittleEndian.Uint64(b[8:]), binary.LittleEndian.Uint64(b[:8]))
+	}
+}
+
+// normalized parses jsn and writes it back with numbers, whether written as
+// ints or floats, and dates, whether relaxed or canonical, in one form
+func normalized(t *testing.T, jsn []byte) string {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(jsn))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("invalid json %s: %v", jsn, err)
+	}
+	out, err := json.Marshal(normalize(t, v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func normalize(t *testing.T, v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, err := val.Float64()
+		if err != nil {
+			t.Fatalf("invalid number %s: %v", val, err)
+		}
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f)
+		}
+		return f
+	case map[string]interface{}:
+		if date, ok := val["$date"]; ok && len(val) == 1 {
+			switch d := date.(type) {
+			case string:
+				parsed, err := time.Parse(time.RFC3339Nano, d)
+				if err != nil {
+					t.Fatalf("invalid $date %s: %v", d, err)
+				}
+				return map[string]interface{}{"$date": parsed.Unix()*1000 + int64(parsed.Nanosecond())/int64(time.Millisecond)}
+			case map[string]interface{}:
+				millis, err := strconv.ParseInt(d["$numberLong"].(string), 10, 64)
+				if err != nil {
+					t.Fatalf("invalid $date %v: %v", d, err)
+				}
+				return map[string]interface{}{"$date": millis}
+			}
+		}
+		for k, elem := range val {
+			val[k] = normalize(t, elem)
+		}
+	case []interface{}:
+		for i, elem := range val {
+			val[i] = normalize(t, elem)
+		}
+	}
+	return v
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+type Client struct {
+	c driverClient
+}
+
+// driverClient is the part of mongodb.Client Client uses, with the session it
+// starts behind an interface so tests can fake it. mongoClient is the
+// implementation over a *mongodb.Client.
+type driverClient interface {
+	Ping(ctx context.Context, rp *readpref.ReadPref) error
+	Disconnect(ctx context.Context) error
+	Database(name string, opts ...*options.DatabaseOptions) *mongodb.Database
+	StartSession(opts ...*options.SessionOptions) (session, error)
+}
+
+type mongoClient struct {
+	*mongodb.Client
+}
+
+func (m mongoClient) StartSession(opts ...*options.SessionOptions) (session, error) {
+	s, err := m.Client.StartSession(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Connect creates a client for the uri and pings the primary to make sure it's
+// reachable. opts are applied after the uri so they take precedence.
+func Connect(ctx context.Context, uri string, opts ...*options.ClientOptions) (*Client, error) {
+	opts = append([]*options.ClientOptions{options.Client().ApplyURI(uri)}, opts...)
+	c, err := mongodb.Connect(ctx, opts...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return connect(ctx, mongoClient{c})
+}
+
+// connect pings c, disconnecting it if the ping fails
+func connect(ctx context.Context, c driverClient) (*Client, error) {
+	client := &Client{c: c}
+	if err := client.Ping(ctx); err != nil {
+		_ = c.Disconnect(ctx)
+		return nil, err
+	}
+	return client, nil
+}
+
+// Ping checks that the server is reachable using the client's read
+// preference. It returns when ctx is done if the server doesn't answer first.
+func (c *Client) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(c.c.Ping(ctx, nil))
+}
+
+func (c *Client) Disconnect(ctx context.Context) error {
+	return errors.WithStack(c.c.Disconnect(ctx))
+}
+
+func (c *Client) Database(name string) *Database {
+	return &Database{d: c.c.Database(name)}
+}
+
+type Database struct {
+	d *mongodb.Database
+}
+
+func (d *Database) Collection(name string) Collection {
+	return NewCollection(d.d.Collection(name))
+}
+
+// session is the part of mongodb.Session WithTransaction uses
+type session interface {
+	WithTransaction(ctx context.Context, fn func(sessCtx mongodb.SessionContext) (interface{}, error), opts ...*options.TransactionOptions) (interface{}, error)
+	EndSession(ctx context.Context)
+}
+
+// WithTransaction runs fn in a transaction that's committed if fn returns nil
+// and aborted otherwise. Collection operations join the transaction when they're
+// passed the context fn receives. fn may be called more than once if the
+// transaction hits a transient error, so it should be safe to retry.
+func (c *Client) WithTransaction(ctx context.Context, fn func(ctx context.Context) error, opts ...*options.TransactionOptions) error {
+	s, err := c.c.StartSession()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return withTransaction(ctx, s, fn, opts...)
+}
+
+// withTransaction runs fn in a transaction on s and ends s. fn's error is
+// returned as is, ahead of the abort error it causes.
+func withTransaction(ctx context.Context, s session, fn func(ctx context.Context) error, opts ...*options.TransactionOptions) error {
+	defer s.EndSession(ctx)
+
+	var fnErr error
+	_, err := s.WithTransaction(ctx, func(sessCtx mongodb.SessionContext) (interface{}, error) {
+		fnErr = fn(sessCtx)
+		return nil, fnErr
+	}, opts...)
+	if fnErr != nil {
+		return fnErr
+	}
+	return errors.WithStack(err)
+}
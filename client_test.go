@@ -0,0 +1,176 @@
+package store
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"testing"
+)
+
+// fakeClient is a driverClient for tests. Ping and Disconnect return pingErr
+// and disconnectErr, Database comes from an unconnected client.
+type fakeClient struct {
+	pingErr       error
+	disconnectErr error
+	pings         int
+	disconnects   int
+	unconnected   *mongodb.Client
+}
+
+func newFakeClient(t *testing.T) *fakeClient {
+	c, err := mongodb.NewClient(options.Client().ApplyURI("mongodb://localhost"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return &fakeClient{unconnected: c}
+}
+
+func (f *fakeClient) Ping(ctx context.Context, rp *readpref.ReadPref) error {
+	f.pings++
+	return f.pingErr
+}
+
+func (f *fakeClient) Disconnect(ctx context.Context) error {
+	f.disconnects++
+	return f.disconnectErr
+}
+
+func (f *fakeClient) Database(name string, opts ...*options.DatabaseOptions) *mongodb.Database {
+	return f.unconnected.Database(name, opts...)
+}
+
+func (f *fakeClient) StartSession(opts ...*options.SessionOptions) (session, error) {
+	panic("StartSession isn't faked")
+}
+
+func TestConnect(t *testing.T) {
+	fake := newFakeClient(t)
+	client, err := connect(context.Background(), fake)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if client.c != fake || fake.pings != 1 || fake.disconnects != 0 {
+		t.Errorf("expected a pinged client, got %d pings and %d disconnects", fake.pings, fake.disconnects)
+	}
+
+	fake = newFakeClient(t)
+	fake.pingErr = errors.New("server selection timeout")
+	client, err = connect(context.Background(), fake)
+	if errors.Cause(err) != fake.pingErr || client != nil {
+		t.Errorf("expected the ping error, got %v %v", client, err)
+	}
+	if fake.disconnects != 1 {
+		t.Errorf("expected the client to be disconnected after the failed ping, got %d disconnects", fake.disconnects)
+	}
+}
+
+func TestPing(t *testing.T) {
+	fake := newFakeClient(t)
+	client := &Client{c: fake}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	fake.pingErr = errors.New("no reachable servers")
+	if err := client.Ping(context.Background()); errors.Cause(err) != fake.pingErr {
+		t.Errorf("expected the ping error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.Ping(ctx); errors.Cause(err) != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if fake.pings != 2 {
+		t.Errorf("expected no ping once ctx is done, got %d pings", fake.pings)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	fake := newFakeClient(t)
+	client := &Client{c: fake}
+	if err := client.Disconnect(context.Background()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fake.disconnectErr = mongodb.ErrClientDisconnected
+	if err := client.Disconnect(context.Background()); errors.Cause(err) != mongodb.ErrClientDisconnected {
+		t.Errorf("expected the disconnect error, got %v", err)
+	}
+	if fake.disconnects != 2 {
+		t.Errorf("expected 2 disconnects, got %d", fake.disconnects)
+	}
+}
+
+func TestDatabase(t *testing.T) {
+	client := &Client{c: newFakeClient(t)}
+	users := client.Database("app").Collection("users")
+	if users.name() != "users" || users.c.DatabaseName() != "app" {
+		t.Errorf("expected app.users, got %s.%s", users.c.DatabaseName(), users.name())
+	}
+}
+
+// fakeTransaction commits when fn succeeds and aborts when it fails, the way
+// mongodb.Session's WithTransaction does, returning commitErr or abortErr
+type fakeTransaction struct {
+	commitErr error
+	abortErr  error
+	committed bool
+	aborted   bool
+	ended     bool
+}
+
+func (f *fakeTransaction) WithTransaction(ctx context.Context, fn func(sessCtx mongodb.SessionContext) (interface{}, error), opts ...*options.TransactionOptions) (interface{}, error) {
+	result, err := fn(mongodb.NewSessionContext(ctx, fakeSession{}))
+	if err != nil {
+		f.aborted = true
+		if f.abortErr != nil {
+			return nil, f.abortErr
+		}
+		return nil, err
+	}
+	f.committed = true
+	return result, f.commitErr
+}
+
+func (f *fakeTransaction) EndSession(ctx context.Context) {
+	f.ended = true
+}
+
+func TestWithTransaction(t *testing.T) {
+	fnErr := errors.New("fn failed")
+	commitErr := errors.New("commit failed")
+	abortErr := errors.New("abort failed")
+	cases := []struct {
+		name      string
+		txn       *fakeTransaction
+		fnErr     error
+		err       error
+		committed bool
+	}{
+		{"commit", &fakeTransaction{}, nil, nil, true},
+		{"commit error", &fakeTransaction{commitErr: commitErr}, nil, commitErr, true},
+		{"abort", &fakeTransaction{}, fnErr, fnErr, false},
+		{"fn's error over the abort error", &fakeTransaction{abortErr: abortErr}, fnErr, fnErr, false},
+	}
+	for _, tc := range cases {
+		var inSession bool
+		err := withTransaction(context.Background(), tc.txn, func(ctx context.Context) error {
+			inSession = mongodb.SessionFromContext(ctx) != nil
+			return tc.fnErr
+		})
+		if errors.Cause(err) != tc.err {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+		if !inSession {
+			t.Errorf("%s: expected fn to get the session's context", tc.name)
+		}
+		if tc.txn.committed != tc.committed || tc.txn.aborted == tc.committed {
+			t.Errorf("%s: expected committed to be %v, got committed %v aborted %v", tc.name, tc.committed, tc.txn.committed, tc.txn.aborted)
+		}
+		if !tc.txn.ended {
+			t.Errorf("%s: expected the session to be ended", tc.name)
+		}
+	}
+}
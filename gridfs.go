@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"time"
+)
+
+// GridFS stores files too large for a document in a GridFS bucket
+type GridFS struct {
+	b bucket
+}
+
+// bucket is the part of gridfs.Bucket GridFS uses, with the streams it opens
+// behind interfaces so tests can fake them. gridfsBucket is the implementation
+// over a *gridfs.Bucket.
+type bucket interface {
+	OpenUploadStreamWithID(fileID interface{}, filename string, opts ...*options.UploadOptions) (uploadStream, error)
+	OpenDownloadStream(fileID interface{}) (downloadStream, error)
+}
+
+// uploadStream is the part of gridfs.UploadStream GridFS uses
+type uploadStream interface {
+	io.Writer
+	SetWriteDeadline(t time.Time) error
+	Close() error
+	Abort() error
+}
+
+// downloadStream is the part of gridfs.DownloadStream GridFS uses
+type downloadStream interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+type gridfsBucket struct {
+	*gridfs.Bucket
+}
+
+func (b gridfsBucket) OpenUploadStreamWithID(fileID interface{}, filename string, opts ...*options.UploadOptions) (uploadStream, error) {
+	us, err := b.Bucket.OpenUploadStreamWithID(fileID, filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return us, nil
+}
+
+func (b gridfsBucket) OpenDownloadStream(fileID interface{}) (downloadStream, error) {
+	ds, err := b.Bucket.OpenDownloadStream(fileID)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// GridFS opens a bucket in the database, the default fs bucket unless opts
+// name another.
+func (d *Database) GridFS(opts ...*options.BucketOptions) (*GridFS, error) {
+	b, err := gridfs.NewBucket(d.d, opts...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &GridFS{b: gridfsBucket{b}}, nil
+}
+
+// Upload stores r's contents as filename and returns the new file's id as hex.
+// The bucket API doesn't take a context, so only ctx's deadline is applied, to
+// the stream this call opens so concurrent calls don't share one.
+func (g *GridFS) Upload(ctx context.Context, filename string, r io.Reader) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	id := primitive.NewObjectID()
+	us, err := g.b.OpenUploadStreamWithID(id, filename)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to upload %s", filename)
+	}
+	deadline, _ := ctx.Deadline()
+	if err := us.SetWriteDeadline(deadline); err != nil {
+		_ = us.Abort()
+		return "", errors.WithStack(err)
+	}
+	if _, err := io.Copy(us, r); err != nil {
+		_ = us.Abort()
+		return "", errors.Wrapf(err, "failed to upload %s", filename)
+	}
+	if err := us.Close(); err != nil {
+		return "", errors.Wrapf(err, "failed to upload %s", filename)
+	}
+	return id.Hex(), nil
+}
+
+// Download writes the file with the hex id to w. It returns ErrNotFound if
+// there's no such file. Like Upload, ctx's deadline is applied to this call's
+// stream.
+func (g *GridFS) Download(ctx context.Context, id string, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return errors.Wrapf(err, "invalid file id %s", id)
+	}
+	ds, err := g.b.OpenDownloadStream(oid)
+	if err != nil {
+		if err == gridfs.ErrFileNotFound {
+			return ErrNotFound
+		}
+		return errors.Wrapf(err, "failed to download %s", id)
+	}
+	defer ds.Close()
+	deadline, _ := ctx.Deadline()
+	if err := ds.SetReadDeadline(deadline); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.Copy(w, ds); err != nil {
+		return errors.Wrapf(err, "failed to download %s", id)
+	}
+	return nil
+}
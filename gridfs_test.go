@@ -0,0 +1,144 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memBucket keeps files in memory, the deadline each stream was given is
+// kept with its file
+type memBucket struct {
+	mu        sync.Mutex
+	files     map[primitive.ObjectID][]byte
+	deadlines map[primitive.ObjectID]time.Time
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{files: map[primitive.ObjectID][]byte{}, deadlines: map[primitive.ObjectID]time.Time{}}
+}
+
+func (m *memBucket) OpenUploadStreamWithID(fileID interface{}, filename string, opts ...*options.UploadOptions) (uploadStream, error) {
+	return &memUpload{bucket: m, id: fileID.(primitive.ObjectID)}, nil
+}
+
+func (m *memBucket) OpenDownloadStream(fileID interface{}) (downloadStream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[fileID.(primitive.ObjectID)]
+	if !ok {
+		return nil, gridfs.ErrFileNotFound
+	}
+	return &memDownload{Reader: bytes.NewReader(data)}, nil
+}
+
+type memUpload struct {
+	bytes.Buffer
+	bucket   *memBucket
+	id       primitive.ObjectID
+	deadline time.Time
+}
+
+func (u *memUpload) SetWriteDeadline(t time.Time) error {
+	u.deadline = t
+	return nil
+}
+
+func (u *memUpload) Close() error {
+	u.bucket.mu.Lock()
+	defer u.bucket.mu.Unlock()
+	u.bucket.files[u.id] = u.Bytes()
+	u.bucket.deadlines[u.id] = u.deadline
+	return nil
+}
+
+func (u *memUpload) Abort() error {
+	return nil
+}
+
+type memDownload struct {
+	*bytes.Reader
+}
+
+func (d *memDownload) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (d *memDownload) Close() error {
+	return nil
+}
+
+func TestGridFS(t *testing.T) {
+	b := newMemBucket()
+	g := &GridFS{b: b}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	content := []byte("attachment contents")
+	id, err := g.Upload(ctx, "notes.txt", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	oid, _ := primitive.ObjectIDFromHex(id)
+	if deadline, _ := ctx.Deadline(); !b.deadlines[oid].Equal(deadline) {
+		t.Errorf("expected the context's deadline to be applied, got %v", b.deadlines[oid])
+	}
+
+	var downloaded bytes.Buffer
+	if err := g.Download(ctx, id, &downloaded); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Errorf("expected %q, got %q", content, downloaded.Bytes())
+	}
+
+	if err := g.Download(ctx, primitive.NewObjectID().Hex(), &downloaded); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := g.Download(ctx, "not hex", &downloaded); err == nil {
+		t.Error("expected an error for an invalid id")
+	}
+}
+
+func TestGridFSConcurrent(t *testing.T) {
+	b := newMemBucket()
+	g := &GridFS{b: b}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			deadline := time.Now().Add(time.Duration(i+1) * time.Minute)
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			defer cancel()
+			content := []byte(fmt.Sprintf("file %d", i))
+			id, err := g.Upload(ctx, fmt.Sprintf("%d.txt", i), bytes.NewReader(content))
+			if err != nil {
+				t.Errorf("%+v", err)
+				return
+			}
+			oid, _ := primitive.ObjectIDFromHex(id)
+			b.mu.Lock()
+			applied := b.deadlines[oid]
+			b.mu.Unlock()
+			if !applied.Equal(deadline) {
+				t.Errorf("file %d: expected its own deadline %v, got %v", i, deadline, applied)
+			}
+			var downloaded bytes.Buffer
+			if err := g.Download(ctx, id, &downloaded); err != nil {
+				t.Errorf("%+v", err)
+				return
+			}
+			if !bytes.Equal(downloaded.Bytes(), content) {
+				t.Errorf("file %d: expected %q, got %q", i, content, downloaded.Bytes())
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,476 @@
+package store
+
+import (
+	"context"
+	jsondec "encoding/json"
+	"fmt"
+	"github.com/dustinevan/mongo/bsoncv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"sync"
+)
+
+var _ MongoCollection = &MockCollection{}
+
+// MockCall is a call recorded by MockCollection. Args are the arguments after
+// the context, variadic options are passed as a single slice.
+type MockCall struct {
+	Method string
+	Args   []interface{}
+}
+
+// MockResult is what a MockCollection method returns. Value must have the
+// method's first return type, a Cursor for Find, Aggregate and Watch, a Decoder
+// for FindOne, an UpdateResult for UpdateOne and so on. Methods that decode
+// into results, FindAll, AggregateAll, AggregateJoin and AggregateMaps, take
+// the Cursor to decode, FindPage a MockPage and Upsert an UpdateResult.
+// FindOneAndDecode takes the document to decode. Drop and Rename only return
+// Err.
+type MockResult struct {
+	Value interface{}
+	Err   error
+}
+
+// MockPage is the result queued for FindPage
+type MockPage struct {
+	Total  int64
+	Cursor Cursor
+}
+
+// MockCollection is a MongoCollection for tests. It records every call and
+// returns the results queued for the method in order. Methods without a
+// queued result succeed with an empty result: Find, Aggregate and Watch return
+// an empty cursor, the methods that decode into results decode nothing,
+// FindOne returns a Decoder that reports ErrNotFound and InsertOne and
+// InsertOneID a new ObjectID.
+type MockCollection struct {
+	mu      sync.Mutex
+	calls   []MockCall
+	results map[string][]MockResult
+}
+
+// Queue adds a result for the next call to method that doesn't have one yet
+func (m *MockCollection) Queue(method string, value interface{}, err error) *MockCollection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.results == nil {
+		m.results = make(map[string][]MockResult)
+	}
+	m.results[method] = append(m.results[method], MockResult{Value: value, Err: err})
+	return m
+}
+
+// Calls returns the recorded calls to method, or every call if method is ""
+func (m *MockCollection) Calls(method string) []MockCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var calls []MockCall
+	for _, c := range m.calls {
+		if method == "" || c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the recorded calls and any results that weren't used
+func (m *MockCollection) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = nil
+	m.results = nil
+}
+
+// call records the call and pops its queued result
+func (m *MockCollection) call(method string, args ...interface{}) (MockResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, MockCall{Method: method, Args: args})
+	queued := m.results[method]
+	if len(queued) == 0 {
+		return MockResult{}, false
+	}
+	m.results[method] = queued[1:]
+	return queued[0], true
+}
+
+func mockTypeError(method string, value interface{}) string {
+	return fmt.Sprintf("the result queued for %s has the wrong type %T", method, value)
+}
+
+func (m *MockCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+	r, ok := m.call("Find", filter, opts)
+	if !ok || r.Value == nil {
+		return NewMockCursor(), r.Err
+	}
+	cur, ok := r.Value.(Cursor)
+	if !ok {
+		panic(mockTypeError("Find", r.Value))
+	}
+	return cur, r.Err
+}
+
+func (m *MockCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) (Decoder, error) {
+	r, ok := m.call("FindOne", filter, opts)
+	if !ok || r.Value == nil {
+		return NewMockDecoder(nil), r.Err
+	}
+	d, ok := r.Value.(Decoder)
+	if !ok {
+		panic(mockTypeError("FindOne", r.Value))
+	}
+	return d, r.Err
+}
+
+// FindOneAndDecode decodes the queued document into destination, a nil
+// document means nothing was found.
+func (m *MockCollection) FindOneAndDecode(ctx context.Context, filter interface{}, destination interface{}) (bool, error) {
+	r, _ := m.call("FindOneAndDecode", filter, destination)
+	if r.Err != nil || r.Value == nil {
+		return false, r.Err
+	}
+	if err := NewMockDecoder(r.Value).Decode(destination); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *MockCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error) {
+	r, ok := m.call("Aggregate", pipeline, opts)
+	if !ok || r.Value == nil {
+		return NewMockCursor(), r.Err
+	}
+	cur, ok := r.Value.(Cursor)
+	if !ok {
+		panic(mockTypeError("Aggregate", r.Value))
+	}
+	return cur, r.Err
+}
+
+// cursor returns the Cursor queued for method, an empty one if there isn't one
+func (m *MockCollection) cursor(method string, r MockResult) Cursor {
+	if r.Value == nil {
+		return NewMockCursor()
+	}
+	cur, ok := r.Value.(Cursor)
+	if !ok {
+		panic(mockTypeError(method, r.Value))
+	}
+	return cur
+}
+
+func (m *MockCollection) FindAll(ctx context.Context, filter interface{}, results interface{}, opts ...*options.FindOptions) error {
+	r, _ := m.call("FindAll", filter, results, opts)
+	if r.Err != nil {
+		return r.Err
+	}
+	return m.cursor("FindAll", r).DecodeAll(ctx, results)
+}
+
+func (m *MockCollection) FindIDs(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]string, error) {
+	r, _ := m.call("FindIDs", filter, opts)
+	if r.Value == nil {
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return []string{}, nil
+	}
+	ids, ok := r.Value.([]string)
+	if !ok {
+		panic(mockTypeError("FindIDs", r.Value))
+	}
+	return ids, r.Err
+}
+
+func (m *MockCollection) FindPage(ctx context.Context, filter interface{}, page, pageSize int64, results interface{}, sort ...string) (int64, error) {
+	r, _ := m.call("FindPage", filter, page, pageSize, results, sort)
+	if r.Err != nil {
+		return 0, r.Err
+	}
+	var p MockPage
+	if r.Value != nil {
+		var ok bool
+		if p, ok = r.Value.(MockPage); !ok {
+			panic(mockTypeError("FindPage", r.Value))
+		}
+	}
+	if p.Cursor == nil {
+		p.Cursor = NewMockCursor()
+	}
+	return p.Total, p.Cursor.DecodeAll(ctx, results)
+}
+
+func (m *MockCollection) Exists(ctx context.Context, filter interface{}) (bool, error) {
+	r, _ := m.call("Exists", filter)
+	if r.Value == nil {
+		return false, r.Err
+	}
+	exists, ok := r.Value.(bool)
+	if !ok {
+		panic(mockTypeError("Exists", r.Value))
+	}
+	return exists, r.Err
+}
+
+func (m *MockCollection) AggregateAll(ctx context.Context, pipeline interface{}, results interface{}, opts ...*options.AggregateOptions) error {
+	r, _ := m.call("AggregateAll", pipeline, results, opts)
+	if r.Err != nil {
+		return r.Err
+	}
+	return m.cursor("AggregateAll", r).DecodeAll(ctx, results)
+}
+
+func (m *MockCollection) AggregateMaps(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) ([]map[string]interface{}, error) {
+	r, _ := m.call("AggregateMaps", pipeline, opts)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	var results []map[string]interface{}
+	if err := m.cursor("AggregateMaps", r).DecodeAll(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (m *MockCollection) AggregateJoin(ctx context.Context, filter interface{}, lookup Lookup, results interface{}, opts ...*options.AggregateOptions) error {
+	r, _ := m.call("AggregateJoin", filter, lookup, results, opts)
+	if r.Err != nil {
+		return r.Err
+	}
+	return m.cursor("AggregateJoin", r).DecodeAll(ctx, results)
+}
+
+func (m *MockCollection) Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (Cursor, error) {
+	r, _ := m.call("Watch", pipeline, opts)
+	return m.cursor("Watch", r), r.Err
+}
+
+func (m *MockCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (string, error) {
+	r, ok := m.call("InsertOne", document, opts)
+	if !ok {
+		return primitive.NewObjectID().Hex(), nil
+	}
+	if r.Value == nil {
+		return "", r.Err
+	}
+	id, ok := r.Value.(string)
+	if !ok {
+		panic(mockTypeError("InsertOne", r.Value))
+	}
+	return id, r.Err
+}
+
+func (m *MockCollection) InsertOneID(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (primitive.ObjectID, error) {
+	r, ok := m.call("InsertOneID", document, opts)
+	if !ok {
+		return primitive.NewObjectID(), nil
+	}
+	if r.Value == nil {
+		return primitive.NilObjectID, r.Err
+	}
+	id, ok := r.Value.(primitive.ObjectID)
+	if !ok {
+		panic(mockTypeError("InsertOneID", r.Value))
+	}
+	return id, r.Err
+}
+
+func (m *MockCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (UpdateResult, error) {
+	r, _ := m.call("UpdateOne", filter, update, opts)
+	if r.Value == nil {
+		return UpdateResult{}, r.Err
+	}
+	result, ok := r.Value.(UpdateResult)
+	if !ok {
+		panic(mockTypeError("UpdateOne", r.Value))
+	}
+	return result, r.Err
+}
+
+// Upsert returns the queued UpdateResult's UpsertedID, created when it isn't
+// empty like Collection.Upsert
+func (m *MockCollection) Upsert(ctx context.Context, filter interface{}, update interface{}) (string, bool, error) {
+	r, _ := m.call("Upsert", filter, update)
+	if r.Value == nil {
+		return "", false, r.Err
+	}
+	result, ok := r.Value.(UpdateResult)
+	if !ok {
+		panic(mockTypeError("Upsert", r.Value))
+	}
+	return result.UpsertedID, result.UpsertedID != "", r.Err
+}
+
+func (m *MockCollection) CreateIndex(ctx context.Context, model mongodb.IndexModel) (string, error) {
+	r, _ := m.call("CreateIndex", model)
+	if r.Value == nil {
+		return "", r.Err
+	}
+	name, ok := r.Value.(string)
+	if !ok {
+		panic(mockTypeError("CreateIndex", r.Value))
+	}
+	return name, r.Err
+}
+
+func (m *MockCollection) CreateIndexes(ctx context.Context, models []mongodb.IndexModel) ([]string, error) {
+	r, _ := m.call("CreateIndexes", models)
+	if r.Value == nil {
+		return nil, r.Err
+	}
+	names, ok := r.Value.([]string)
+	if !ok {
+		panic(mockTypeError("CreateIndexes", r.Value))
+	}
+	return names, r.Err
+}
+
+func (m *MockCollection) BulkWrite(ctx context.Context, models []mongodb.WriteModel, opts ...*options.BulkWriteOptions) (BulkResult, error) {
+	r, _ := m.call("BulkWrite", models, opts)
+	if r.Value == nil {
+		return BulkResult{}, r.Err
+	}
+	result, ok := r.Value.(BulkResult)
+	if !ok {
+		panic(mockTypeError("BulkWrite", r.Value))
+	}
+	return result, r.Err
+}
+
+func (m *MockCollection) BulkUpsert(ctx context.Context, key string, documents []interface{}) (BulkResult, error) {
+	r, _ := m.call("BulkUpsert", key, documents)
+	if r.Value == nil {
+		return BulkResult{}, r.Err
+	}
+	result, ok := r.Value.(BulkResult)
+	if !ok {
+		panic(mockTypeError("BulkUpsert", r.Value))
+	}
+	return result, r.Err
+}
+
+func (m *MockCollection) Drop(ctx context.Context) error {
+	r, _ := m.call("Drop")
+	return r.Err
+}
+
+func (m *MockCollection) Rename(ctx context.Context, newName string) error {
+	r, _ := m.call("Rename", newName)
+	return r.Err
+}
+
+// MockCursor is a Cursor over documents held in memory. They're marshalled to
+// bson up front so they decode through the same path as real results.
+type MockCursor struct {
+	docs [][]byte
+	idx  int
+	// returned by Err once the documents run out
+	err    error
+	closed bool
+	buf    []byte
+}
+
+// NewMockCursor marshals docs to bson, it panics if one can't be marshalled
+func NewMockCursor(docs ...interface{}) *MockCursor {
+	m := &MockCursor{idx: -1}
+	for _, d := range docs {
+		bsn, err := bson.Marshal(d)
+		if err != nil {
+			panic(fmt.Sprintf("failed to marshal mock document %v: %v", d, err))
+		}
+		m.docs = append(m.docs, bsn)
+	}
+	return m
+}
+
+// WithErr makes Err return err once the documents run out
+func (m *MockCursor) WithErr(err error) *MockCursor {
+	m.err = err
+	return m
+}
+
+func (m *MockCursor) Decode(val interface{}) error {
+	return json.Unmarshal(m.Current(), val)
+}
+
+func (m *MockCursor) Err() error {
+	if m.idx+1 < len(m.docs) {
+		return nil
+	}
+	return m.err
+}
+
+func (m *MockCursor) Next(ctx context.Context) bool {
+	if m.closed || m.idx+1 >= len(m.docs) {
+		return false
+	}
+	m.idx++
+	return true
+}
+
+func (m *MockCursor) Close(ctx context.Context) error {
+	m.closed = true
+	return nil
+}
+
+func (m *MockCursor) ID() int64 {
+	return 0
+}
+
+func (m *MockCursor) Current() []byte {
+	return bsoncv.ToJson(m.docs[m.idx])
+}
+
+func (m *MockCursor) WriteJSONArray(ctx context.Context, w io.Writer) error {
+	return writeJSONArray(ctx, m, w)
+}
+
+func (m *MockCursor) CurrentJSON() jsondec.RawMessage {
+	return m.Current()
+}
+
+func (m *MockCursor) DecodeRaw() []byte {
+	m.buf = bsoncv.AppendJson(m.buf[:0], m.docs[m.idx], bsoncv.JsonOptions{})
+	return m.buf
+}
+
+func (m *MockCursor) DecodeBSON(val interface{}) error {
+	return bson.Unmarshal(m.docs[m.idx], val)
+}
+
+func (m *MockCursor) DecodeAll(ctx context.Context, results interface{}) error {
+	return decodeAll(ctx, m, results)
+}
+
+func (m *MockCursor) All(ctx context.Context) func(yield func([]byte, error) bool) {
+	return iterate(ctx, m)
+}
+
+// NewMockDecoder returns a Decoder for doc, a nil doc behaves like a FindOne
+// that matched nothing. It panics if doc can't be marshalled to bson.
+func NewMockDecoder(doc interface{}) Decoder {
+	if doc == nil {
+		return &decoder{result: mockSingleResult{err: mongodb.ErrNoDocuments}}
+	}
+	bsn, err := bson.Marshal(doc)
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal mock document %v: %v", doc, err))
+	}
+	return &decoder{result: mockSingleResult{doc: bsn}}
+}
+
+type mockSingleResult struct {
+	doc bson.Raw
+	err error
+}
+
+func (m mockSingleResult) DecodeBytes() (bson.Raw, error) {
+	return m.doc, m.err
+}
+
+func (m mockSingleResult) Err() error {
+	return m.err
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"reflect"
+	"testing"
+)
+
+func TestMockCollection(t *testing.T) {
+	ctx := context.Background()
+	m := &MockCollection{}
+	m.Queue("Find", NewMockCursor(bson.D{{Key: "_id", Value: "1"}, {Key: "name", Value: "one"}}), nil).
+		Queue("Find", nil, errors.New("find failed")).
+		Queue("InsertOne", "abc", nil)
+
+	cur, err := m.Find(ctx, bson.D{{Key: "name", Value: "one"}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var results []testDoc
+	if err := cur.DecodeAll(ctx, &results); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(results, []testDoc{{ID: "1", Name: "one"}}) {
+		t.Errorf("unexpected results %v", results)
+	}
+	if _, err := m.Find(ctx, bson.D{}); err == nil || err.Error() != "find failed" {
+		t.Errorf("expected the second queued error, got %v", err)
+	}
+	// nothing left queued, so an empty cursor
+	cur, err = m.Find(ctx, bson.D{})
+	if err != nil || cur.Next(ctx) {
+		t.Errorf("expected an empty cursor, got %v", err)
+	}
+
+	if id, err := m.InsertOne(ctx, testDoc{Name: "two"}); err != nil || id != "abc" {
+		t.Errorf("expected the queued id, got %q %v", id, err)
+	}
+	if id, err := m.InsertOne(ctx, testDoc{Name: "three"}); err != nil || len(id) != 24 {
+		t.Errorf("expected a generated ObjectID, got %q %v", id, err)
+	}
+
+	d, err := m.FindOne(ctx, bson.D{})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var doc testDoc
+	if err := d.Decode(&doc); !IsNotFound(err) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	m.Queue("FindOneAndDecode", bson.D{{Key: "_id", Value: "4"}, {Key: "name", Value: "four"}}, nil)
+	found, err := m.FindOneAndDecode(ctx, bson.D{}, &doc)
+	if err != nil || !found || doc != (testDoc{ID: "4", Name: "four"}) {
+		t.Errorf("unexpected FindOneAndDecode %v %v %v", found, err, doc)
+	}
+
+	if calls := m.Calls("Find"); len(calls) != 3 || !reflect.DeepEqual(calls[0].Args[0], bson.D{{Key: "name", Value: "one"}}) {
+		t.Errorf("unexpected Find calls %v", calls)
+	}
+	if calls := m.Calls("InsertOne"); len(calls) != 2 || calls[1].Args[0] != (testDoc{Name: "three"}) {
+		t.Errorf("unexpected InsertOne calls %v", calls)
+	}
+	if calls := m.Calls(""); len(calls) != 7 {
+		t.Errorf("expected 7 calls, got %d", len(calls))
+	}
+	m.Reset()
+	if calls := m.Calls(""); len(calls) != 0 {
+		t.Errorf("expected Reset to forget the calls, got %v", calls)
+	}
+}
+
+func TestMockCollectionWrongType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a result of the wrong type")
+		}
+	}()
+	m := &MockCollection{}
+	m.Queue("InsertOne", 5, nil)
+	_, _ = m.InsertOne(context.Background(), testDoc{})
+}
+
+func TestMockCollectionHelpers(t *testing.T) {
+	ctx := context.Background()
+	m := &MockCollection{}
+	one := bson.D{{Key: "_id", Value: "1"}, {Key: "name", Value: "one"}}
+	m.Queue("FindAll", NewMockCursor(one), nil).
+		Queue("FindPage", MockPage{Total: 11, Cursor: NewMockCursor(one)}, nil).
+		Queue("FindIDs", []string{"1", "2"}, nil).
+		Queue("Exists", true, nil).
+		Queue("AggregateAll", NewMockCursor(one), nil).
+		Queue("AggregateMaps", NewMockCursor(one), nil).
+		Queue("AggregateJoin", nil, errors.New("join failed")).
+		Queue("UpdateOne", UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil).
+		Queue("Upsert", UpdateResult{UpsertedCount: 1, UpsertedID: "abc"}, nil).
+		Queue("BulkUpsert", BulkResult{UpsertedCount: 2}, nil).
+		Queue("Rename", nil, errors.New("rename failed"))
+
+	var results []testDoc
+	if err := m.FindAll(ctx, bson.D{}, &results); err != nil || !reflect.DeepEqual(results, []testDoc{{ID: "1", Name: "one"}}) {
+		t.Errorf("unexpected FindAll %v %v", results, err)
+	}
+	// nothing left queued, so no documents
+	if err := m.FindAll(ctx, bson.D{}, &results); err != nil || results == nil || len(results) != 0 {
+		t.Errorf("expected an empty slice, got %#v %v", results, err)
+	}
+	if total, err := m.FindPage(ctx, bson.D{}, 2, 10, &results, "-name"); err != nil || total != 11 || len(results) != 1 {
+		t.Errorf("unexpected FindPage %d %v %v", total, results, err)
+	}
+	if ids, err := m.FindIDs(ctx, bson.D{}); err != nil || !reflect.DeepEqual(ids, []string{"1", "2"}) {
+		t.Errorf("unexpected FindIDs %v %v", ids, err)
+	}
+	if exists, err := m.Exists(ctx, bson.D{}); err != nil || !exists {
+		t.Errorf("unexpected Exists %v %v", exists, err)
+	}
+	if exists, err := m.Exists(ctx, bson.D{}); err != nil || exists {
+		t.Errorf("expected false with nothing queued, got %v %v", exists, err)
+	}
+	if err := m.AggregateAll(ctx, mongodb.Pipeline{}, &results); err != nil || len(results) != 1 {
+		t.Errorf("unexpected AggregateAll %v %v", results, err)
+	}
+	if maps, err := m.AggregateMaps(ctx, mongodb.Pipeline{}); err != nil || len(maps) != 1 || maps[0]["name"] != "one" {
+		t.Errorf("unexpected AggregateMaps %v %v", maps, err)
+	}
+	lookup := Lookup{From: "customers", LocalField: "customerId", ForeignField: "_id", As: "customer"}
+	if err := m.AggregateJoin(ctx, nil, lookup, &results); err == nil || err.Error() != "join failed" {
+		t.Errorf("expected the queued error, got %v", err)
+	}
+	if cur, err := m.Watch(ctx, mongodb.Pipeline{}); err != nil || cur.Next(ctx) {
+		t.Errorf("expected an empty change stream, got %v", err)
+	}
+	if r, err := m.UpdateOne(ctx, bson.D{}, bson.D{}); err != nil || r.ModifiedCount != 1 {
+		t.Errorf("unexpected UpdateOne %+v %v", r, err)
+	}
+	if id, created, err := m.Upsert(ctx, bson.D{}, bson.D{}); err != nil || id != "abc" || !created {
+		t.Errorf("unexpected Upsert %q %v %v", id, created, err)
+	}
+	if id, created, err := m.Upsert(ctx, bson.D{}, bson.D{}); err != nil || id != "" || created {
+		t.Errorf("expected an update with nothing queued, got %q %v %v", id, created, err)
+	}
+	if r, err := m.BulkUpsert(ctx, "_id", []interface{}{one}); err != nil || r.UpsertedCount != 2 {
+		t.Errorf("unexpected BulkUpsert %+v %v", r, err)
+	}
+	if err := m.Drop(ctx); err != nil {
+		t.Errorf("unexpected Drop error %v", err)
+	}
+	if err := m.Rename(ctx, "archive"); err == nil || err.Error() != "rename failed" {
+		t.Errorf("expected the queued error, got %v", err)
+	}
+
+	if calls := m.Calls("FindPage"); len(calls) != 1 || calls[0].Args[1] != int64(2) || !reflect.DeepEqual(calls[0].Args[4], []string{"-name"}) {
+		t.Errorf("unexpected FindPage calls %v", calls)
+	}
+	if calls := m.Calls("Rename"); len(calls) != 1 || calls[0].Args[0] != "archive" {
+		t.Errorf("unexpected Rename calls %v", calls)
+	}
+}
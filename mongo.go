@@ -2,23 +2,71 @@ package store
 
 import (
 	"context"
+	jsondec "encoding/json"
 	"fmt"
+	"github.com/dustinevan/mongo/bsoncv"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	mongodb "go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"github.com/dustinevan/mongo/bsoncv"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
+// jsonAPI returns api, or the package's config when it's nil
+func jsonAPI(api jsoniter.API) jsoniter.API {
+	if api == nil {
+		return json
+	}
+	return api
+}
+
+// ErrNotFound is returned when decoding the result of a FindOne that matched
+// no documents.
+var ErrNotFound = errors.New("document not found")
+
+// IsNotFound reports whether err, or the error it wraps, means no document
+// was found.
+func IsNotFound(err error) bool {
+	cause := errors.Cause(err)
+	return cause == ErrNotFound || cause == mongodb.ErrNoDocuments
+}
+
 type MongoCollection interface {
 	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error)
 	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) (Decoder, error)
 	FindOneAndDecode(ctx context.Context, filter interface{}, destination interface{}) (bool, error)
+	FindAll(ctx context.Context, filter interface{}, results interface{}, opts ...*options.FindOptions) error
+	FindIDs(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]string, error)
+	FindPage(ctx context.Context, filter interface{}, page, pageSize int64, results interface{}, sort ...string) (int64, error)
+	Exists(ctx context.Context, filter interface{}) (bool, error)
 	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error)
+	AggregateAll(ctx context.Context, pipeline interface{}, results interface{}, opts ...*options.AggregateOptions) error
+	AggregateMaps(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) ([]map[string]interface{}, error)
+	AggregateJoin(ctx context.Context, filter interface{}, lookup Lookup, results interface{}, opts ...*options.AggregateOptions) error
+	Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (Cursor, error)
 	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (string, error)
+	InsertOneID(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (primitive.ObjectID, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (UpdateResult, error)
+	Upsert(ctx context.Context, filter interface{}, update interface{}) (string, bool, error)
+	CreateIndex(ctx context.Context, model mongodb.IndexModel) (string, error)
+	CreateIndexes(ctx context.Context, models []mongodb.IndexModel) ([]string, error)
+	BulkWrite(ctx context.Context, models []mongodb.WriteModel, opts ...*options.BulkWriteOptions) (BulkResult, error)
+	BulkUpsert(ctx context.Context, key string, documents []interface{}) (BulkResult, error)
+	Drop(ctx context.Context) error
+	Rename(ctx context.Context, newName string) error
 }
 
 type Cursor interface {
@@ -28,96 +76,1244 @@ type Cursor interface {
 	Close(ctx context.Context) error
 	ID() int64
 	Current() []byte
+	// CurrentJSON is Current typed so it can be embedded in a larger json
+	// response without being marshalled again.
+	CurrentJSON() jsondec.RawMessage
+	DecodeAll(ctx context.Context, results interface{}) error
+	// DecodeRaw returns the current document as json without unmarshalling
+	// it. The returned slice is reused and is only valid until the next call
+	// to Next.
+	DecodeRaw() []byte
+	// DecodeBSON decodes the current document with bson.Unmarshal instead of
+	// going through json, so int64s, ObjectIDs and Decimal128s keep their types.
+	DecodeBSON(val interface{}) error
+	// All returns an iter.Seq2[[]byte, error] over the remaining documents as
+	// json, see iterate.
+	All(ctx context.Context) func(yield func([]byte, error) bool)
+	// WriteJSONArray streams the remaining documents to w as a json array and
+	// closes the cursor, see writeJSONArray.
+	WriteJSONArray(ctx context.Context, w io.Writer) error
 }
 
 type cursor struct {
 	mongodb.Cursor
+	// reused by DecodeRaw
+	buf []byte
+	// decodes documents, see Collection.WithJSON
+	api jsoniter.API
 }
 
 func (m *cursor) Current() []byte {
 	return bsoncv.ToJson(m.Cursor.Current)
 }
 
+func (m *cursor) WriteJSONArray(ctx context.Context, w io.Writer) error {
+	return writeJSONArray(ctx, m, w)
+}
+
+func (m *cursor) CurrentJSON() jsondec.RawMessage {
+	return m.Current()
+}
+
 func (m *cursor) Decode(val interface{}) error {
-	return json.Unmarshal(m.Current(), val)
+	return jsonAPI(m.api).Unmarshal(m.Current(), val)
+}
+
+func (m *cursor) DecodeRaw() []byte {
+	m.buf = bsoncv.AppendJson(m.buf[:0], m.Cursor.Current, bsoncv.JsonOptions{})
+	return m.buf
+}
+
+func (m *cursor) DecodeBSON(val interface{}) error {
+	return errors.WithStack(bson.Unmarshal(m.Cursor.Current, val))
 }
 
 func (m *cursor) Close(ctx context.Context) error {
-	return m.Close(ctx)
+	return m.Cursor.Close(ctx)
+}
+
+// DecodeAll decodes every remaining document into the slice results points to
+// and closes the cursor.
+func (m *cursor) DecodeAll(ctx context.Context, results interface{}) error {
+	return decodeAll(ctx, m, results)
+}
+
+func (m *cursor) All(ctx context.Context) func(yield func([]byte, error) bool) {
+	return iterate(ctx, m)
+}
+
+// iterate returns an iterator over the json of cur's remaining documents that
+// closes cur when the loop ends, including on break. With Go 1.23:
+//
+//	for doc, err := range cur.All(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// An error is only ever the last value yielded, it's ctx's error if ctx is done
+// before the documents run out.
+func iterate(ctx context.Context, cur Cursor) func(yield func([]byte, error) bool) {
+	return func(yield func([]byte, error) bool) {
+		for cur.Next(ctx) {
+			if err := ctx.Err(); err != nil {
+				_ = cur.Close(ctx)
+				yield(nil, errors.WithStack(err))
+				return
+			}
+			if !yield(cur.Current(), nil) {
+				_ = cur.Close(ctx)
+				return
+			}
+		}
+		err := errors.WithStack(cur.Err())
+		if cerr := cur.Close(ctx); cerr != nil && err == nil {
+			err = errors.WithStack(cerr)
+		}
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// writeJSONArray writes cur's remaining documents to w as a json array, one
+// document at a time so the array is never held in memory. An empty cursor is
+// written as []. cur is closed whether it succeeds or not, but if it fails
+// part of the array may already have been written.
+func writeJSONArray(ctx context.Context, cur Cursor, w io.Writer) (err error) {
+	defer func() {
+		if cerr := cur.Close(ctx); cerr != nil && err == nil {
+			err = errors.WithStack(cerr)
+		}
+	}()
+	sep := []byte{'['}
+	for cur.Next(ctx) {
+		if err := ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := w.Write(sep); err != nil {
+			return errors.WithStack(err)
+		}
+		sep[0] = ','
+		if _, err := w.Write(cur.DecodeRaw()); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	if sep[0] == '[' {
+		_, err = w.Write([]byte("[]"))
+	} else {
+		_, err = w.Write([]byte{']'})
+	}
+	return errors.WithStack(err)
+}
+
+func decodeAll(ctx context.Context, cur Cursor, results interface{}) (err error) {
+	defer func() {
+		if cerr := cur.Close(ctx); cerr != nil && err == nil {
+			err = errors.WithStack(cerr)
+		}
+	}()
+	if err := checkResults(results); err != nil {
+		return err
+	}
+	sliceVal := reflect.ValueOf(results).Elem()
+	elemType := sliceVal.Type().Elem()
+
+	decoded := reflect.MakeSlice(sliceVal.Type(), 0, 0)
+	for cur.Next(ctx) {
+		// stop a long scan as soon as the caller gives up on it
+		if err := ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		elem := reflect.New(elemType)
+		if err := cur.Decode(elem.Interface()); err != nil {
+			return errors.Wrap(err, "failed to decode")
+		}
+		decoded = reflect.Append(decoded, elem.Elem())
+	}
+	if err := cur.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	sliceVal.Set(decoded)
+	return nil
+}
+
+// checkResults makes sure results is a pointer to a slice decodeAll can fill
+func checkResults(results interface{}) error {
+	if results == nil {
+		return errors.New("results must be a pointer to a slice, got nil")
+	}
+	sliceVal := reflect.ValueOf(results)
+	if sliceVal.Kind() != reflect.Ptr || sliceVal.IsNil() || sliceVal.Elem().Kind() != reflect.Slice {
+		return errors.Errorf("results must be a pointer to a slice, got %T", results)
+	}
+	return nil
+}
+
+// changeStream gives change events the same json treatment as documents read
+// through a cursor.
+type changeStream struct {
+	*mongodb.ChangeStream
+	// reused by DecodeRaw
+	buf []byte
+	// decodes documents, see Collection.WithJSON
+	api jsoniter.API
+}
+
+func (m *changeStream) Current() []byte {
+	return bsoncv.ToJson(m.ChangeStream.Current)
+}
+
+func (m *changeStream) DecodeRaw() []byte {
+	m.buf = bsoncv.AppendJson(m.buf[:0], m.ChangeStream.Current, bsoncv.JsonOptions{})
+	return m.buf
+}
+
+func (m *changeStream) DecodeBSON(val interface{}) error {
+	return errors.WithStack(bson.Unmarshal(m.ChangeStream.Current, val))
+}
+
+// WriteJSONArray blocks until the change stream is closed or ctx is done
+func (m *changeStream) WriteJSONArray(ctx context.Context, w io.Writer) error {
+	return writeJSONArray(ctx, m, w)
+}
+
+func (m *changeStream) CurrentJSON() jsondec.RawMessage {
+	return m.Current()
+}
+
+func (m *changeStream) Decode(val interface{}) error {
+	return jsonAPI(m.api).Unmarshal(m.Current(), val)
+}
+
+func (m *changeStream) All(ctx context.Context) func(yield func([]byte, error) bool) {
+	return iterate(ctx, m)
+}
+
+// DecodeAll blocks until the change stream is closed or ctx is done
+func (m *changeStream) DecodeAll(ctx context.Context, results interface{}) error {
+	return decodeAll(ctx, m, results)
 }
 
 type Decoder interface {
 	DecodeBytes() ([]byte, error)
+	// DecodeBytesRaw returns the document's bson as the driver read it, without
+	// converting it to json.
+	DecodeBytesRaw() ([]byte, error)
 	Decode(val interface{}) error
+	// DecodeBSON decodes with bson.Unmarshal instead of going through json, so
+	// int64s, ObjectIDs and Decimal128s keep their types.
+	DecodeBSON(val interface{}) error
+	Err() error
+}
+
+// singleResult is the part of mongodb.SingleResult decoder uses
+type singleResult interface {
+	DecodeBytes() (bson.Raw, error)
 	Err() error
 }
 
 type decoder struct {
-	mongodb.SingleResult
+	result singleResult
+	// the converted document, so DecodeBytes and Decode only convert once
+	converted []byte
+	// decodes the document, see Collection.WithJSON
+	api jsoniter.API
+}
+
+func (m *decoder) Err() error {
+	return m.result.Err()
 }
 
+func (m *decoder) jsonBytes() ([]byte, error) {
+	if m.converted != nil {
+		return m.converted, nil
+	}
+	data, err := m.result.DecodeBytes()
+	if err != nil {
+		return nil, err
+	}
+	m.converted = bsoncv.ToJson(data)
+	return m.converted, nil
+}
+
+// DecodeBytes returns ErrNotFound if the FindOne matched no documents. The
+// returned bytes are reused by Decode and shouldn't be modified.
 func (m *decoder) DecodeBytes() ([]byte, error) {
-	data, err := m.SingleResult.DecodeBytes()
+	data, err := m.jsonBytes()
+	if err != nil {
+		if err == mongodb.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to decode bytes")
+	}
+	return data, nil
+}
+
+// DecodeBytesRaw returns ErrNotFound if the FindOne matched no documents
+func (m *decoder) DecodeBytesRaw() ([]byte, error) {
+	data, err := m.result.DecodeBytes()
 	if err != nil {
+		if err == mongodb.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
 		return nil, errors.Wrap(err, "failed to decode bytes")
 	}
-	return bsoncv.ToJson(data), nil
+	return data, nil
 }
 
+// DecodeBSON returns ErrNotFound if the FindOne matched no documents
+func (m *decoder) DecodeBSON(val interface{}) error {
+	data, err := m.result.DecodeBytes()
+	if err != nil {
+		if err == mongodb.ErrNoDocuments {
+			return ErrNotFound
+		}
+		return errors.Wrap(err, "failed to decode")
+	}
+	return errors.WithStack(bson.Unmarshal(data, val))
+}
+
+// Decode returns ErrNotFound if the FindOne matched no documents
 func (m *decoder) Decode(val interface{}) error {
-	data, err := m.SingleResult.DecodeBytes()
+	data, err := m.jsonBytes()
 	if err != nil {
+		if err == mongodb.ErrNoDocuments {
+			return ErrNotFound
+		}
 		return errors.Wrap(err, "failed to decode")
 	}
-	return json.Unmarshal(bsoncv.ToJson(data), val)
+	return jsonAPI(m.api).Unmarshal(data, val)
 }
 
+var _ MongoCollection = Collection{}
+
 type Collection struct {
-	c *mongodb.Collection
+	c       driverCollection
+	timeout time.Duration
+	// decodes results, the package's config when nil
+	api jsoniter.API
+	// attempts and backoff are set by WithRetry
+	attempts int
+	backoff  time.Duration
+	// set by WithObserver
+	observer Observer
+	// set by WithTracing and WithTracedFilters
+	tracer       trace.Tracer
+	traceFilters bool
 }
 
-func (c Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
-	cur, err := c.c.Find(ctx, filter, opts...)
+// driverCollection is the part of mongodb.Collection Collection uses, with the
+// cursors and results it returns behind interfaces so tests can fake it.
+// mongoCollection is the implementation over a *mongodb.Collection.
+type driverCollection interface {
+	Name() string
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) singleResult
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error)
+	Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (Cursor, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongodb.InsertOneResult, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongodb.UpdateResult, error)
+	BulkWrite(ctx context.Context, models []mongodb.WriteModel, opts ...*options.BulkWriteOptions) (*mongodb.BulkWriteResult, error)
+	Indexes() indexCreator
+	Clone(opts ...*options.CollectionOptions) driverCollection
+	Drop(ctx context.Context) error
+	DatabaseName() string
+	RunAdminCommand(ctx context.Context, cmd interface{}) error
+}
+
+// indexCreator is the part of mongodb.IndexView Collection uses
+type indexCreator interface {
+	CreateOne(ctx context.Context, model mongodb.IndexModel, opts ...*options.CreateIndexesOptions) (string, error)
+	CreateMany(ctx context.Context, models []mongodb.IndexModel, opts ...*options.CreateIndexesOptions) ([]string, error)
+}
+
+// mongoCollection is the driverCollection of a *mongodb.Collection. Cursors
+// decode with the package's config until Collection sets its own, see withAPI.
+type mongoCollection struct {
+	*mongodb.Collection
+}
+
+func (m mongoCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+	cur, err := m.Collection.Find(ctx, filter, opts...)
 	if err != nil {
-		err = errors.WithStack(err)
+		return nil, err
 	}
-	if cur == nil {
+	return &cursor{Cursor: *cur}, nil
+}
+
+func (m mongoCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) singleResult {
+	return m.Collection.FindOne(ctx, filter, opts...)
+}
+
+func (m mongoCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error) {
+	cur, err := m.Collection.Aggregate(ctx, pipeline, opts...)
+	if err != nil {
 		return nil, err
 	}
-	return &cursor{*cur}, err
+	return &cursor{Cursor: *cur}, nil
+}
+
+func (m mongoCollection) Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (Cursor, error) {
+	stream, err := m.Collection.Watch(ctx, pipeline, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &changeStream{ChangeStream: stream}, nil
+}
+
+func (m mongoCollection) Indexes() indexCreator {
+	return m.Collection.Indexes()
+}
+
+// Clone drops the driver's error, Clone only copies the collection's settings
+// and never returns one
+func (m mongoCollection) Clone(opts ...*options.CollectionOptions) driverCollection {
+	cloned, _ := m.Collection.Clone(opts...)
+	return mongoCollection{cloned}
+}
+
+func (m mongoCollection) DatabaseName() string {
+	return m.Database().Name()
+}
+
+// RunAdminCommand runs cmd against the admin database of the collection's client
+func (m mongoCollection) RunAdminCommand(ctx context.Context, cmd interface{}) error {
+	return m.Database().Client().Database("admin").RunCommand(ctx, cmd).Err()
+}
+
+// withAPI makes a cursor from the driver decode with api, see WithJSON
+func withAPI(cur Cursor, api jsoniter.API) Cursor {
+	switch cur := cur.(type) {
+	case *cursor:
+		cur.api = api
+	case *changeStream:
+		cur.api = api
+	}
+	return cur
+}
+
+// NewCollection wraps a driver collection so its reads go through the bsoncv
+// conversions:
+//
+//	client, err := mongodb.Connect(ctx, options.Client().ApplyURI(uri))
+//	...
+//	users := store.NewCollection(client.Database("app").Collection("users"))
+func NewCollection(c *mongodb.Collection) Collection {
+	return Collection{c: mongoCollection{c}}
+}
+
+// Raw returns the driver collection for operations Collection doesn't cover.
+// Documents read through it skip the bsoncv conversions.
+func (c Collection) Raw() *mongodb.Collection {
+	m, _ := c.c.(mongoCollection)
+	return m.Collection
+}
+
+// WithTimeout returns a copy of the collection whose operations time out after
+// d when the context passed to them has no deadline of its own.
+func (c Collection) WithTimeout(d time.Duration) Collection {
+	c.timeout = d
+	return c
+}
+
+// WithJSON returns a copy of the collection whose cursors and decoders decode
+// with api instead of jsoniter.ConfigCompatibleWithStandardLibrary, e.g.
+//
+//	strict := users.WithJSON(jsoniter.Config{DisallowUnknownFields: true}.Froze())
+func (c Collection) WithJSON(api jsoniter.API) Collection {
+	c.api = api
+	return c
+}
+
+// WithRetry returns a copy of the collection whose operations are attempted up
+// to maxAttempts times while they fail with a retryable error. Reads are
+// retried after timeouts and network errors, writes only when the server labels
+// the error RetryableWriteError, since attempting an insert or update again
+// could apply it twice. Nothing is retried inside a session, where the
+// transaction decides what runs again. The wait between attempts starts at
+// backoff and doubles after each one. Other errors are returned right away.
+func (c Collection) WithRetry(maxAttempts int, backoff time.Duration) Collection {
+	c.attempts = maxAttempts
+	c.backoff = backoff
+	return c
+}
+
+// Observer is called after each operation with the name of the driver method
+// it ran, e.g. Find or InsertOne, how long it took including any retries and
+// the error it returned.
+type Observer func(op string, d time.Duration, err error)
+
+// WithObserver returns a copy of the collection that calls fn after each
+// operation, e.g. to record latency per operation:
+//
+//	users = users.WithObserver(func(op string, d time.Duration, err error) {
+//		latency.WithLabelValues("users", op).Observe(d.Seconds())
+//	})
+func (c Collection) WithObserver(fn Observer) Collection {
+	c.observer = fn
+	return c
+}
+
+// WithTracing returns a copy of the collection that runs each operation in an
+// OpenTelemetry span from tp, named mongo.<op>, e.g. mongo.Find, with the
+// collection's name and any error recorded on it. Retries happen within the one
+// span.
+//
+//	users = users.WithTracing(otel.GetTracerProvider())
+func (c Collection) WithTracing(tp trace.TracerProvider) Collection {
+	c.tracer = tp.Tracer("github.com/dustinevan/mongo")
+	return c
+}
+
+// WithTracedFilters returns a copy of the collection whose spans also have the
+// operation's filter as extended json. Filters can hold personal data, so
+// they're left out unless this is called.
+func (c Collection) WithTracedFilters() Collection {
+	c.traceFilters = true
+	return c
+}
+
+// startSpan starts the span op runs in, end records op's error and ends it
+func (c Collection) startSpan(ctx context.Context, op string, filter interface{}) (context.Context, func(err error)) {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.operation", op),
+		attribute.String("db.mongodb.collection", c.name()),
+	}
+	if c.traceFilters && filter != nil {
+		if f, err := bson.MarshalExtJSON(filter, false, false); err == nil {
+			attrs = append(attrs, attribute.String("db.mongodb.filter", string(f)))
+		}
+	}
+	ctx, span := c.tracer.Start(ctx, "mongo."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// name returns the driver collection's name, "" for a zero Collection
+func (c Collection) name() string {
+	if c.c == nil {
+		return ""
+	}
+	return c.c.Name()
+}
+
+// WithWriteConcern returns a copy of the collection whose writes use wc, e.g.
+// majority acknowledgement for writes that can't be lost:
+//
+//	payments := c.WithWriteConcern(writeconcern.New(writeconcern.WMajority()))
+func (c Collection) WithWriteConcern(wc *writeconcern.WriteConcern) Collection {
+	return c.withOptions(options.Collection().SetWriteConcern(wc))
+}
+
+// WithReadPreference returns a copy of the collection whose reads use rp, e.g.
+// secondaries for reporting queries:
+//
+//	reports := c.WithReadPreference(readpref.SecondaryPreferred())
+func (c Collection) WithReadPreference(rp *readpref.ReadPref) Collection {
+	return c.withOptions(options.Collection().SetReadPreference(rp))
+}
+
+// withOptions returns a copy of the collection wrapping a clone of the driver
+// collection with opts applied
+func (c Collection) withOptions(opts *options.CollectionOptions) Collection {
+	c.c = c.c.Clone(opts)
+	return c
+}
+
+// retry runs op until it succeeds, fails with an error that isn't retryable,
+// the attempts run out or ctx is done. name is passed to the observer and
+// tracer, filter only to the tracer and may be nil.
+func (c Collection) retry(ctx context.Context, name string, filter interface{}, retryable func(err error) bool, op func(ctx context.Context) error) (err error) {
+	if c.tracer != nil {
+		var end func(err error)
+		ctx, end = c.startSpan(ctx, name, filter)
+		defer func() {
+			end(err)
+		}()
+	}
+	if c.observer != nil {
+		start := time.Now()
+		defer func() {
+			c.observer(name, time.Since(start), err)
+		}()
+	}
+	err = op(ctx)
+	if mongodb.SessionFromContext(ctx) != nil {
+		return err
+	}
+	for attempt := 1; attempt < c.attempts && err != nil && retryable(err); attempt++ {
+		wait := time.NewTimer(c.backoff << (attempt - 1))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return err
+		case <-wait.C:
+		}
+		err = op(ctx)
+	}
+	return err
+}
+
+// deadlineMaxTime returns the time left before ctx's deadline, if it has one.
+// MaxTime is sent in milliseconds and 0 means no limit, so it's at least 1ms.
+func deadlineMaxTime(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	d := time.Until(deadline)
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d, true
+}
+
+func findMaxTimeSet(opts []*options.FindOptions) bool {
+	for _, o := range opts {
+		if o != nil && o.MaxTime != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func aggregateMaxTimeSet(opts []*options.AggregateOptions) bool {
+	for _, o := range opts {
+		if o != nil && o.MaxTime != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// labeledError is implemented by the driver's server errors
+type labeledError interface {
+	HasErrorLabel(label string) bool
+}
+
+// isRetryableRead reports whether a read failed with a timeout or a network
+// error, which running it again can't make worse.
+func isRetryableRead(err error) bool {
+	return mongodb.IsTimeout(err) || mongodb.IsNetworkError(err)
+}
+
+// isRetryableWrite reports whether err carries the label the server attaches
+// when a write can safely be sent again.
+func isRetryableWrite(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if le, ok := err.(labeledError); ok && le.HasErrorLabel("RetryableWriteError") {
+			return true
+		}
+	}
+	return false
+}
+
+// opContext derives the context an operation runs with. A context that already
+// has a deadline is never extended or shortened.
+func (c Collection) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || c.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// Find runs the query. When ctx has a deadline and no option sets MaxTime, the
+// time left is sent as MaxTime so the server stops when the caller gives up.
+func (c Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	if d, ok := deadlineMaxTime(ctx); ok && !findMaxTimeSet(opts) {
+		// copied so the caller's slice isn't appended to
+		opts = append(opts[:len(opts):len(opts)], options.Find().SetMaxTime(d))
+	}
+	var cur Cursor
+	err := c.retry(ctx, "Find", filter, isRetryableRead, func(ctx context.Context) (err error) {
+		cur, err = c.c.Find(ctx, filter, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return withAPI(cur, c.api), nil
 }
 
 func (c Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) (Decoder, error) {
-	singleResult := c.c.FindOne(ctx, filter, opts...)
-	err := singleResult.Err()
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	var singleResult singleResult
+	err := c.retry(ctx, "FindOne", filter, isRetryableRead, func(ctx context.Context) error {
+		singleResult = c.c.FindOne(ctx, filter, opts...)
+		return singleResult.Err()
+	})
 	if err != nil {
 		if err == mongodb.ErrNoDocuments {
-			return &decoder{*singleResult}, nil
+			return &decoder{result: singleResult, api: c.api}, nil
 		}
 		err = errors.WithStack(err)
 	}
-	return &decoder{*singleResult}, err
+	return &decoder{result: singleResult, api: c.api}, err
 }
 
+// FindOneAndDecode decodes the first document matching filter into
+// destination. It returns false if there wasn't one.
+func (c Collection) FindOneAndDecode(ctx context.Context, filter interface{}, destination interface{}) (bool, error) {
+	d, err := c.FindOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	if err := d.Decode(destination); err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Aggregate runs the pipeline. Like Find, the time left before ctx's deadline
+// is sent as MaxTime unless an option sets it.
 func (c Collection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error) {
-	cur, err := c.c.Aggregate(ctx, pipeline, opts...)
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	if d, ok := deadlineMaxTime(ctx); ok && !aggregateMaxTimeSet(opts) {
+		opts = append(opts[:len(opts):len(opts)], options.Aggregate().SetMaxTime(d))
+	}
+	var cur Cursor
+	err := c.retry(ctx, "Aggregate", nil, isRetryableRead, func(ctx context.Context) (err error) {
+		cur, err = c.c.Aggregate(ctx, pipeline, opts...)
+		return err
+	})
 	if err != nil {
-		err = errors.WithStack(err)
+		return nil, errors.WithStack(err)
+	}
+	return withAPI(cur, c.api), nil
+}
+
+// Watch opens a change stream on the collection. Change events, including
+// their fullDocument, are decoded through the same json path as Find results.
+func (c Collection) Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (Cursor, error) {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	var stream Cursor
+	err := c.retry(ctx, "Watch", nil, isRetryableRead, func(ctx context.Context) (err error) {
+		stream, err = c.c.Watch(ctx, pipeline, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return withAPI(stream, c.api), nil
+}
+
+// FindAll runs the query and decodes every result into the slice results
+// points to. The slice is empty, not nil, when nothing matches.
+func (c Collection) FindAll(ctx context.Context, filter interface{}, results interface{}, opts ...*options.FindOptions) error {
+	if err := checkResults(results); err != nil {
+		return err
+	}
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	cur, err := c.Find(ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	return cur.DecodeAll(ctx, results)
+}
+
+// FindIDs returns the _id of every document matching filter, ObjectIDs as hex
+// and numbers in decimal. Only _id is projected, whatever projection opts set.
+func (c Collection) FindIDs(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]string, error) {
+	var docs []struct {
+		ID interface{} `json:"_id"`
+	}
+	// the last options win, so the projection can't be overridden. Copied so
+	// the caller's slice isn't appended to.
+	opts = append(opts[:len(opts):len(opts)], options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err := c.FindAll(ctx, filter, &docs, opts...); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(docs))
+	for i, d := range docs {
+		ids[i] = idString(d.ID)
+	}
+	return ids, nil
+}
+
+// DefaultPageSize is used by FindPage when pageSize isn't positive
+const DefaultPageSize = 20
+
+// Sort builds a sort document from field names, ascending unless they start
+// with -, e.g. newest first and then by name:
+//
+//	err := users.FindAll(ctx, filter, &results, options.Find().SetSort(store.Sort("-created", "name")))
+func Sort(fields ...string) bson.D {
+	sort := make(bson.D, 0, len(fields))
+	for _, f := range fields {
+		switch {
+		case strings.HasPrefix(f, "-"):
+			sort = append(sort, bson.E{Key: f[1:], Value: -1})
+		case strings.HasPrefix(f, "+"):
+			sort = append(sort, bson.E{Key: f[1:], Value: 1})
+		default:
+			sort = append(sort, bson.E{Key: f, Value: 1})
+		}
+	}
+	return sort
+}
+
+// Include returns Find options projecting only the fields, plus _id unless
+// it's passed as -_id:
+//
+//	projection, err := store.Include("name", "email", "-_id")
+//	if err != nil {
+//		return err
+//	}
+//	err = users.FindAll(ctx, filter, &results, projection)
+//
+// A projection can't mix included and excluded fields other than _id, so Include
+// returns an error if another field starts with -.
+func Include(fields ...string) (*options.FindOptions, error) {
+	projection := make(bson.D, 0, len(fields))
+	for _, f := range fields {
+		if f == "-_id" {
+			projection = append(projection, bson.E{Key: "_id", Value: 0})
+			continue
+		}
+		if strings.HasPrefix(f, "-") {
+			return nil, errors.Errorf("can't exclude %s, only -_id can be mixed with included fields", f[1:])
+		}
+		projection = append(projection, bson.E{Key: f, Value: 1})
+	}
+	return options.Find().SetProjection(projection), nil
+}
+
+// Exclude returns Find options projecting every field but the fields
+func Exclude(fields ...string) *options.FindOptions {
+	projection := make(bson.D, 0, len(fields))
+	for _, f := range fields {
+		projection = append(projection, bson.E{Key: f, Value: 0})
+	}
+	return options.Find().SetProjection(projection)
+}
+
+// pageOptions returns the Find options for a 1 based page sorted by the fields,
+// see Sort, and then _id so pages are stable between requests
+func pageOptions(page, pageSize int64, sort ...string) *options.FindOptions {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	order := Sort(sort...)
+	hasID := false
+	for _, e := range order {
+		hasID = hasID || e.Key == "_id"
+	}
+	if !hasID {
+		order = append(order, bson.E{Key: "_id", Value: 1})
+	}
+	return options.Find().
+		SetSkip((page - 1) * pageSize).
+		SetLimit(pageSize).
+		SetSort(order)
+}
+
+// FindPage decodes one page of the documents matching filter into the slice
+// results points to and returns the total number of matching documents. Pages
+// start at 1, a page below 1 is treated as 1 and a pageSize that isn't positive
+// as DefaultPageSize. Documents are sorted by the sort fields, see Sort, and
+// then by _id.
+func (c Collection) FindPage(ctx context.Context, filter interface{}, page, pageSize int64, results interface{}, sort ...string) (total int64, err error) {
+	if err := checkResults(results); err != nil {
+		return 0, err
+	}
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	err = c.retry(ctx, "CountDocuments", filter, isRetryableRead, func(ctx context.Context) (err error) {
+		total, err = c.c.CountDocuments(ctx, filter)
+		return err
+	})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if err := c.FindAll(ctx, filter, results, pageOptions(page, pageSize, sort...)); err != nil {
+		return total, err
+	}
+	return total, nil
+}
+
+// Exists reports whether any document matches filter. It counts with a limit
+// of 1 so the server stops at the first match.
+func (c Collection) Exists(ctx context.Context, filter interface{}) (bool, error) {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	var n int64
+	err := c.retry(ctx, "CountDocuments", filter, isRetryableRead, func(ctx context.Context) (err error) {
+		n, err = c.c.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+		return err
+	})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n > 0, nil
+}
+
+// AggregateAll runs the pipeline and decodes every result into the slice
+// results points to.
+func (c Collection) AggregateAll(ctx context.Context, pipeline interface{}, results interface{}, opts ...*options.AggregateOptions) error {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	cur, err := c.Aggregate(ctx, pipeline, opts...)
+	if err != nil {
+		return err
 	}
-	if cur == nil {
+	return cur.DecodeAll(ctx, results)
+}
+
+// AggregateMaps is AggregateAll for pipelines without a struct to decode into.
+// Values are decoded from the converted json, so ObjectIDs are hex strings,
+// dates are strings and numbers are float64s.
+func (c Collection) AggregateMaps(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) ([]map[string]interface{}, error) {
+	var results []map[string]interface{}
+	if err := c.AggregateAll(ctx, pipeline, &results, opts...); err != nil {
 		return nil, err
 	}
-	return &cursor{*cur}, err
+	return results, nil
+}
+
+// Lookup joins the documents of another collection in the same database whose
+// ForeignField equals the LocalField of each document, adding them as an array
+// named As.
+type Lookup struct {
+	// the collection to join
+	From         string
+	LocalField   string
+	ForeignField string
+	As           string
+}
+
+// Stage returns the $lookup stage for a pipeline
+func (l Lookup) Stage() bson.D {
+	return bson.D{{Key: "$lookup", Value: bson.D{
+		{Key: "from", Value: l.From},
+		{Key: "localField", Value: l.LocalField},
+		{Key: "foreignField", Value: l.ForeignField},
+		{Key: "as", Value: l.As},
+	}}}
+}
+
+// AggregateJoin decodes the documents matching filter, each with the documents
+// lookup joins to it, into the slice results points to. A nil filter matches
+// every document. For example, orders with their customer:
+//
+//	err := orders.AggregateJoin(ctx, bson.D{{Key: "status", Value: "open"}}, store.Lookup{
+//		From: "customers", LocalField: "customerId", ForeignField: "_id", As: "customer",
+//	}, &results)
+func (c Collection) AggregateJoin(ctx context.Context, filter interface{}, lookup Lookup, results interface{}, opts ...*options.AggregateOptions) error {
+	return c.AggregateAll(ctx, joinPipeline(filter, lookup), results, opts...)
+}
+
+// joinPipeline matches filter, unless it's nil, and then runs lookup
+func joinPipeline(filter interface{}, lookup Lookup) mongodb.Pipeline {
+	var pipeline mongodb.Pipeline
+	if filter != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter}})
+	}
+	return append(pipeline, lookup.Stage())
+}
+
+// AggregateOpts holds the aggregate options most pipelines need. Zero fields
+// are left unset:
+//
+//	err := users.AggregateAll(ctx, pipeline, &results, store.AggregateOpts{AllowDiskUse: true}.Options())
+type AggregateOpts struct {
+	AllowDiskUse bool
+	BatchSize    int32
+	// Comment shows up in the profiler and server logs
+	Comment string
+	MaxTime time.Duration
+}
+
+// Options converts o for Aggregate and AggregateAll
+func (o AggregateOpts) Options() *options.AggregateOptions {
+	opts := options.Aggregate()
+	if o.AllowDiskUse {
+		opts.SetAllowDiskUse(true)
+	}
+	if o.BatchSize > 0 {
+		opts.SetBatchSize(o.BatchSize)
+	}
+	if o.Comment != "" {
+		opts.SetComment(o.Comment)
+	}
+	if o.MaxTime > 0 {
+		opts.SetMaxTime(o.MaxTime)
+	}
+	return opts
 }
 
 func (c Collection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (string, error) {
-	insertResult, err := c.c.InsertOne(ctx, document, opts...)
+	insertedID, err := c.insertOne(ctx, document, opts...)
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", err
 	}
-	if id, ok := insertResult.InsertedID.(primitive.ObjectID); !ok {
-		panic(fmt.Sprintf("the inserted documents ObjectID wasn't of type primitive.ObjectID %v", insertResult))
+	if id, ok := insertedID.(primitive.ObjectID); !ok {
+		panic(fmt.Sprintf("the inserted documents ObjectID wasn't of type primitive.ObjectID %v", insertedID))
 	} else {
 		return id.Hex(), nil
 	}
 }
+
+// InsertOneID is InsertOne returning the ObjectID itself. Documents with an _id
+// of another type are still inserted, but an error is returned with the zero
+// ObjectID.
+func (c Collection) InsertOneID(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (primitive.ObjectID, error) {
+	insertedID, err := c.insertOne(ctx, document, opts...)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	id, ok := insertedID.(primitive.ObjectID)
+	if !ok {
+		return primitive.NilObjectID, errors.Errorf("the inserted document's _id %v is a %T, not a primitive.ObjectID", insertedID, insertedID)
+	}
+	return id, nil
+}
+
+func (c Collection) insertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (interface{}, error) {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	var insertResult *mongodb.InsertOneResult
+	err := c.retry(ctx, "InsertOne", nil, isRetryableWrite, func(ctx context.Context) (err error) {
+		insertResult, err = c.c.InsertOne(ctx, document, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return insertResult.InsertedID, nil
+}
+
+type UpdateResult struct {
+	MatchedCount  int64
+	ModifiedCount int64
+	UpsertedCount int64
+	// empty unless the update inserted a document
+	UpsertedID string
+}
+
+func newUpdateResult(r *mongodb.UpdateResult) UpdateResult {
+	if r == nil {
+		return UpdateResult{}
+	}
+	result := UpdateResult{
+		MatchedCount:  r.MatchedCount,
+		ModifiedCount: r.ModifiedCount,
+		UpsertedCount: r.UpsertedCount,
+	}
+	if r.UpsertedID != nil {
+		result.UpsertedID = idString(r.UpsertedID)
+	}
+	return result
+}
+
+func (c Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (UpdateResult, error) {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	var r *mongodb.UpdateResult
+	err := c.retry(ctx, "UpdateOne", filter, isRetryableWrite, func(ctx context.Context) (err error) {
+		r, err = c.c.UpdateOne(ctx, filter, update, opts...)
+		return err
+	})
+	if err != nil {
+		return UpdateResult{}, errors.WithStack(err)
+	}
+	return newUpdateResult(r), nil
+}
+
+// Upsert runs update with upsert set. created is true if no document matched
+// and one was inserted, id is then the new document's _id. The driver doesn't
+// report the _id of a document that was updated, so id is empty when created
+// is false.
+func (c Collection) Upsert(ctx context.Context, filter interface{}, update interface{}) (id string, created bool, err error) {
+	r, err := c.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return "", false, err
+	}
+	return r.UpsertedID, r.UpsertedID != "", nil
+}
+
+// CreateIndex creates the index and returns its name
+func (c Collection) CreateIndex(ctx context.Context, model mongodb.IndexModel) (string, error) {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	var name string
+	err := c.retry(ctx, "CreateIndex", nil, isRetryableWrite, func(ctx context.Context) (err error) {
+		name, err = c.c.Indexes().CreateOne(ctx, model)
+		return err
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return name, nil
+}
+
+// CreateIndexes creates the indexes and returns their names
+func (c Collection) CreateIndexes(ctx context.Context, models []mongodb.IndexModel) ([]string, error) {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	var names []string
+	err := c.retry(ctx, "CreateIndexes", nil, isRetryableWrite, func(ctx context.Context) (err error) {
+		names, err = c.c.Indexes().CreateMany(ctx, models)
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return names, nil
+}
+
+type BulkResult struct {
+	InsertedCount int64
+	MatchedCount  int64
+	ModifiedCount int64
+	DeletedCount  int64
+	UpsertedCount int64
+	// keyed by the index of the upserting model
+	UpsertedIDs map[int64]string
+}
+
+func newBulkResult(r *mongodb.BulkWriteResult) BulkResult {
+	if r == nil {
+		return BulkResult{}
+	}
+	result := BulkResult{
+		InsertedCount: r.InsertedCount,
+		MatchedCount:  r.MatchedCount,
+		ModifiedCount: r.ModifiedCount,
+		DeletedCount:  r.DeletedCount,
+		UpsertedCount: r.UpsertedCount,
+		UpsertedIDs:   make(map[int64]string, len(r.UpsertedIDs)),
+	}
+	for i, id := range r.UpsertedIDs {
+		result.UpsertedIDs[i] = idString(id)
+	}
+	return result
+}
+
+// idString returns ObjectIDs as hex and any other id in its default format
+func idString(id interface{}) string {
+	switch v := id.(type) {
+	case primitive.ObjectID:
+		return v.Hex()
+	case string:
+		return v
+	case float64:
+		// numbers read back through json, without an exponent for large ints
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// BulkWrite runs the models in a single batch. If some of the writes fail the
+// result of the ones that succeeded is returned along with the error.
+func (c Collection) BulkWrite(ctx context.Context, models []mongodb.WriteModel, opts ...*options.BulkWriteOptions) (BulkResult, error) {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	var r *mongodb.BulkWriteResult
+	err := c.retry(ctx, "BulkWrite", nil, isRetryableWrite, func(ctx context.Context) (err error) {
+		r, err = c.c.BulkWrite(ctx, models, opts...)
+		return err
+	})
+	return newBulkResult(r), errors.WithStack(err)
+}
+
+// BulkUpsert upserts each document matching on its key field, e.g.
+// externalId, in a single BulkWrite. Every other field is $set, except _id
+// which is only written when the document is inserted so it never changes.
+// It's an error if a document doesn't have the key. Structs are converted with
+// their bsoncv tags. With no documents there's nothing to write, so the result
+// is empty.
+func (c Collection) BulkUpsert(ctx context.Context, key string, documents []interface{}) (BulkResult, error) {
+	if len(documents) == 0 {
+		return BulkResult{}, nil
+	}
+	models := make([]mongodb.WriteModel, 0, len(documents))
+	for i, document := range documents {
+		bsn, err := marshalDocument(document)
+		if err != nil {
+			return BulkResult{}, errors.Wrapf(err, "failed to marshal document %d", i)
+		}
+		var fields bson.M
+		if err := bson.Unmarshal(bsn, &fields); err != nil {
+			return BulkResult{}, errors.Wrapf(err, "failed to unmarshal document %d", i)
+		}
+		value, ok := fields[key]
+		if !ok {
+			return BulkResult{}, errors.Errorf("document %d has no %s", i, key)
+		}
+		update := bson.D{}
+		if id, ok := fields["_id"]; ok {
+			delete(fields, "_id")
+			update = append(update, bson.E{Key: "$setOnInsert", Value: bson.M{"_id": id}})
+		}
+		update = append(update, bson.E{Key: "$set", Value: fields})
+		models = append(models, mongodb.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: key, Value: value}}).
+			SetUpdate(update).
+			SetUpsert(true))
+	}
+	return c.BulkWrite(ctx, models)
+}
+
+// marshalDocument converts a struct, or a pointer to one, with bsoncv.ToBson
+// and leaves anything else, e.g. a bson.D, to the driver
+func marshalDocument(document interface{}) ([]byte, error) {
+	v := reflect.ValueOf(document)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Struct {
+		return bsoncv.ToBson(document)
+	}
+	return bson.Marshal(document)
+}
+
+// Drop drops the collection. Dropping a collection that doesn't exist isn't an
+// error.
+func (c Collection) Drop(ctx context.Context) error {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	return errors.WithStack(c.retry(ctx, "Drop", nil, isRetryableWrite, c.c.Drop))
+}
+
+// Rename renames the collection within its database. c keeps referring to the
+// old name, use Database.Collection(newName) for the renamed collection.
+func (c Collection) Rename(ctx context.Context, newName string) error {
+	ctx, cancel := c.opContext(ctx)
+	defer cancel()
+	// renameCollection has to be run against the admin database
+	db := c.c.DatabaseName()
+	cmd := bson.D{
+		{Key: "renameCollection", Value: db + "." + c.c.Name()},
+		{Key: "to", Value: db + "." + newName},
+	}
+	return errors.WithStack(c.retry(ctx, "Rename", nil, isRetryableWrite, func(ctx context.Context) error {
+		return c.c.RunAdminCommand(ctx, cmd)
+	}))
+}
@@ -0,0 +1,1394 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	jsondec "encoding/json"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mongodb "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var objectId = primitive.ObjectID([12]byte{1, 35, 69, 103, 137, 171, 205, 239, 1, 35, 69, 103})
+
+type testDoc struct {
+	ID   string `json:"_id"`
+	Name string `json:"name"`
+}
+
+func TestDecodeAll(t *testing.T) {
+	cur := NewMockCursor(
+		bson.D{{Key: "_id", Value: "1"}, {Key: "name", Value: "one"}},
+		bson.D{{Key: "_id", Value: "2"}, {Key: "name", Value: "two"}},
+	)
+	var results []testDoc
+	if err := cur.DecodeAll(context.Background(), &results); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := []testDoc{{ID: "1", Name: "one"}, {ID: "2", Name: "two"}}
+	if !reflect.DeepEqual(expected, results) {
+		t.Errorf("expected: %v\nactual:   %v", expected, results)
+	}
+	if !cur.closed {
+		t.Error("expected the cursor to be closed")
+	}
+
+	var notASlice testDoc
+	if err := NewMockCursor().DecodeAll(context.Background(), &notASlice); err == nil {
+		t.Error("expected an error decoding into a non-slice")
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	c := NewCollection(nil).WithTimeout(time.Second)
+
+	ctx, cancel := c.opContext(context.Background())
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Second {
+		t.Errorf("expected a deadline within a second, got %v %v", deadline, ok)
+	}
+
+	earlier, cancelEarlier := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelEarlier()
+	ctx, cancel = c.opContext(earlier)
+	defer cancel()
+	if ctx != earlier {
+		t.Error("expected a context with a deadline to be used as is")
+	}
+
+	later, cancelLater := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelLater()
+	ctx, cancel = c.opContext(later)
+	defer cancel()
+	if ctx != later {
+		t.Error("expected a context with a later deadline not to be shortened")
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		expected bool
+	}{
+		{ErrNotFound, true},
+		{errors.Wrap(ErrNotFound, "failed to find user"), true},
+		{mongodb.ErrNoDocuments, true},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	} {
+		if actual := IsNotFound(c.err); actual != c.expected {
+			t.Errorf("IsNotFound(%v): expected %v, got %v", c.err, c.expected, actual)
+		}
+	}
+}
+
+// fakeCollection is a driverCollection for tests. Each method calls the func
+// of the same name, a test only sets the ones it expects to be called.
+type fakeCollection struct {
+	find      func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error)
+	aggregate func(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error)
+	count     func(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+	insert    func(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongodb.InsertOneResult, error)
+	update    func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongodb.UpdateResult, error)
+	bulkWrite func(ctx context.Context, models []mongodb.WriteModel, opts ...*options.BulkWriteOptions) (*mongodb.BulkWriteResult, error)
+	clone     func(opts ...*options.CollectionOptions) driverCollection
+	drop      func(ctx context.Context) error
+	admin     func(ctx context.Context, cmd interface{}) error
+	indexes   indexCreator
+}
+
+func (f *fakeCollection) Name() string {
+	return "fake"
+}
+
+func (f *fakeCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+	return f.find(ctx, filter, opts...)
+}
+
+func (f *fakeCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) singleResult {
+	panic("FindOne isn't faked")
+}
+
+func (f *fakeCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error) {
+	return f.aggregate(ctx, pipeline, opts...)
+}
+
+func (f *fakeCollection) Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (Cursor, error) {
+	panic("Watch isn't faked")
+}
+
+func (f *fakeCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	return f.count(ctx, filter, opts...)
+}
+
+func (f *fakeCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongodb.InsertOneResult, error) {
+	return f.insert(ctx, document, opts...)
+}
+
+func (f *fakeCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongodb.UpdateResult, error) {
+	return f.update(ctx, filter, update, opts...)
+}
+
+func (f *fakeCollection) BulkWrite(ctx context.Context, models []mongodb.WriteModel, opts ...*options.BulkWriteOptions) (*mongodb.BulkWriteResult, error) {
+	return f.bulkWrite(ctx, models, opts...)
+}
+
+func (f *fakeCollection) Indexes() indexCreator {
+	return f.indexes
+}
+
+func (f *fakeCollection) Clone(opts ...*options.CollectionOptions) driverCollection {
+	return f.clone(opts...)
+}
+
+func (f *fakeCollection) Drop(ctx context.Context) error {
+	return f.drop(ctx)
+}
+
+func (f *fakeCollection) DatabaseName() string {
+	return "test"
+}
+
+func (f *fakeCollection) RunAdminCommand(ctx context.Context, cmd interface{}) error {
+	return f.admin(ctx, cmd)
+}
+
+type fakeIndexView struct {
+	models []mongodb.IndexModel
+}
+
+func (f *fakeIndexView) CreateOne(ctx context.Context, model mongodb.IndexModel, opts ...*options.CreateIndexesOptions) (string, error) {
+	f.models = append(f.models, model)
+	return "email_1", nil
+}
+
+func (f *fakeIndexView) CreateMany(ctx context.Context, models []mongodb.IndexModel, opts ...*options.CreateIndexesOptions) ([]string, error) {
+	f.models = append(f.models, models...)
+	return []string{"email_1", "created_-1"}, nil
+}
+
+func TestCreateIndexes(t *testing.T) {
+	view := &fakeIndexView{}
+	c := Collection{c: &fakeCollection{indexes: view}}
+	email := mongodb.IndexModel{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)}
+	created := mongodb.IndexModel{Keys: bson.D{{Key: "created", Value: -1}}}
+
+	name, err := c.CreateIndex(context.Background(), email)
+	if err != nil || name != "email_1" {
+		t.Errorf("expected email_1, got %s %v", name, err)
+	}
+	names, err := c.CreateIndexes(context.Background(), []mongodb.IndexModel{email, created})
+	if err != nil || !reflect.DeepEqual(names, []string{"email_1", "created_-1"}) {
+		t.Errorf("expected [email_1 created_-1], got %v %v", names, err)
+	}
+	if !reflect.DeepEqual(view.models, []mongodb.IndexModel{email, email, created}) {
+		t.Errorf("expected the models to reach the index view, got %v", view.models)
+	}
+}
+
+func TestNewBulkResult(t *testing.T) {
+	actual := newBulkResult(&mongodb.BulkWriteResult{
+		InsertedCount: 1,
+		MatchedCount:  2,
+		ModifiedCount: 2,
+		DeletedCount:  3,
+		UpsertedCount: 2,
+		UpsertedIDs: map[int64]interface{}{
+			4: objectId,
+			6: "external-6",
+		},
+	})
+	expected := BulkResult{
+		InsertedCount: 1,
+		MatchedCount:  2,
+		ModifiedCount: 2,
+		DeletedCount:  3,
+		UpsertedCount: 2,
+		UpsertedIDs: map[int64]string{
+			4: "0123456789abcdef01234567",
+			6: "external-6",
+		},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %+v\nactual:   %+v", expected, actual)
+	}
+}
+
+func TestDecodeAllGroupResults(t *testing.T) {
+	// results of [{$group: {_id: "$status", count: {$sum: 1}, total: {$sum: "$amount"}}}]
+	cur := NewMockCursor(
+		bson.D{{Key: "_id", Value: "paid"}, {Key: "count", Value: int32(2)}, {Key: "total", Value: 30.5}},
+		bson.D{{Key: "_id", Value: "refunded"}, {Key: "count", Value: int32(1)}, {Key: "total", Value: 12.25}},
+	)
+	type group struct {
+		Status string  `json:"_id"`
+		Count  int     `json:"count"`
+		Total  float64 `json:"total"`
+	}
+	var results []group
+	if err := cur.DecodeAll(context.Background(), &results); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := []group{{"paid", 2, 30.5}, {"refunded", 1, 12.25}}
+	if !reflect.DeepEqual(expected, results) {
+		t.Errorf("expected: %v\nactual:   %v", expected, results)
+	}
+}
+
+// countingResult counts the documents fetched from the result, each one is
+// converted to json once
+type countingResult struct {
+	singleResult
+	fetches int
+}
+
+func (c *countingResult) DecodeBytes() (bson.Raw, error) {
+	c.fetches++
+	return c.singleResult.DecodeBytes()
+}
+
+func TestDecoderConvertsOnce(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{{Key: "_id", Value: "1"}, {Key: "name", Value: "one"}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	result := &countingResult{singleResult: mockSingleResult{doc: raw}}
+	d := &decoder{result: result}
+	data, err := d.DecodeBytes()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var doc testDoc
+	if err := d.Decode(&doc); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if string(data) != `{"_id":"1","name":"one"}` || doc != (testDoc{ID: "1", Name: "one"}) {
+		t.Errorf("unexpected results %s %+v", data, doc)
+	}
+	if result.fetches != 1 {
+		t.Errorf("expected 1 conversion, got %d", result.fetches)
+	}
+
+	notFound := &decoder{result: mockSingleResult{err: mongodb.ErrNoDocuments}}
+	if err := notFound.Decode(&doc); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := notFound.DecodeBytes(); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func benchmarkDocs() []interface{} {
+	docs := make([]interface{}, 100)
+	for i := range docs {
+		docs[i] = bson.D{{Key: "_id", Value: objectId}, {Key: "name", Value: "name"}, {Key: "count", Value: int32(i)}}
+	}
+	return docs
+}
+
+func BenchmarkCursorDecode(b *testing.B) {
+	cur := NewMockCursor(benchmarkDocs()...)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cur.idx = -1
+		for cur.Next(context.Background()) {
+			var doc testDoc
+			if err := cur.Decode(&doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkCursorDecodeRaw(b *testing.B) {
+	cur := NewMockCursor(benchmarkDocs()...)
+	iter := jsoniter.ParseBytes(json, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cur.idx = -1
+		for cur.Next(context.Background()) {
+			var doc testDoc
+			iter.ResetBytes(cur.DecodeRaw())
+			for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+				switch field {
+				case "_id":
+					doc.ID = iter.ReadString()
+				case "name":
+					doc.Name = iter.ReadString()
+				default:
+					iter.Skip()
+				}
+			}
+			if iter.Error != nil {
+				b.Fatal(iter.Error)
+			}
+		}
+	}
+}
+
+func TestDecodeBSON(t *testing.T) {
+	price, err := primitive.ParseDecimal128("19.99")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type order struct {
+		ID     primitive.ObjectID   `bson:"_id"`
+		Amount int64                `bson:"amount"`
+		Price  primitive.Decimal128 `bson:"price"`
+	}
+	expected := order{ID: objectId, Amount: 1<<62 + 1, Price: price}
+	raw, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: expected.ID},
+		{Key: "amount", Value: expected.Amount},
+		{Key: "price", Value: expected.Price},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	cur := NewMockCursor(bson.Raw(raw))
+	cur.Next(context.Background())
+	var fromCursor order
+	if err := cur.DecodeBSON(&fromCursor); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if fromCursor != expected {
+		t.Errorf("expected: %+v\nactual:   %+v", expected, fromCursor)
+	}
+
+	var fromDecoder order
+	if err := (&decoder{result: mockSingleResult{doc: raw}}).DecodeBSON(&fromDecoder); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if fromDecoder != expected {
+		t.Errorf("expected: %+v\nactual:   %+v", expected, fromDecoder)
+	}
+
+	notFound := &decoder{result: mockSingleResult{err: mongodb.ErrNoDocuments}}
+	if err := notFound.DecodeBSON(&fromDecoder); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	raw := &mongodb.Collection{}
+	if NewCollection(raw).WithTimeout(time.Second).Raw() != raw {
+		t.Error("expected Raw to return the wrapped collection")
+	}
+}
+
+func TestFindAll(t *testing.T) {
+	var cur *MockCursor
+	c := Collection{c: &fakeCollection{find: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+		return cur, nil
+	}}}
+
+	cur = NewMockCursor(
+		bson.D{{Key: "_id", Value: "1"}, {Key: "name", Value: "one"}},
+		bson.D{{Key: "_id", Value: "2"}, {Key: "name", Value: "two"}},
+	)
+	var results []testDoc
+	if err := c.FindAll(context.Background(), bson.D{}, &results); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := []testDoc{{ID: "1", Name: "one"}, {ID: "2", Name: "two"}}
+	if !reflect.DeepEqual(expected, results) {
+		t.Errorf("expected: %v\nactual:   %v", expected, results)
+	}
+	if !cur.closed {
+		t.Error("expected the cursor to be closed")
+	}
+
+	cur = NewMockCursor()
+	var empty []testDoc
+	if err := c.FindAll(context.Background(), bson.D{}, &empty); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if empty == nil || len(empty) != 0 {
+		t.Errorf("expected an empty non-nil slice, got %#v", empty)
+	}
+
+	if err := c.FindAll(context.Background(), bson.D{}, nil); err == nil || err.Error() != "results must be a pointer to a slice, got nil" {
+		t.Errorf("expected a nil results error, got %v", err)
+	}
+}
+
+func TestPageOptions(t *testing.T) {
+	for _, c := range []struct {
+		page, pageSize int64
+		skip, limit    int64
+	}{
+		{1, 10, 0, 10},
+		{3, 10, 20, 10},
+		{2, 25, 25, 25},
+		{0, 10, 0, 10},
+		{-4, 10, 0, 10},
+		{2, 0, DefaultPageSize, DefaultPageSize},
+		{3, -1, 2 * DefaultPageSize, DefaultPageSize},
+	} {
+		opts := pageOptions(c.page, c.pageSize)
+		if *opts.Skip != c.skip || *opts.Limit != c.limit {
+			t.Errorf("page %d size %d: expected skip %d limit %d, got skip %d limit %d",
+				c.page, c.pageSize, c.skip, c.limit, *opts.Skip, *opts.Limit)
+		}
+		if !reflect.DeepEqual(opts.Sort, bson.D{{Key: "_id", Value: 1}}) {
+			t.Errorf("expected an _id sort, got %v", opts.Sort)
+		}
+	}
+}
+
+func TestFindPage(t *testing.T) {
+	var findOpts []*options.FindOptions
+	c := Collection{c: &fakeCollection{
+		find: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+			findOpts = opts
+			return NewMockCursor(bson.D{{Key: "_id", Value: "3"}, {Key: "name", Value: "three"}}), nil
+		},
+		count: func(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+			return 5, nil
+		},
+	}}
+	var results []testDoc
+	total, err := c.FindPage(context.Background(), bson.D{}, 2, 2, &results)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if total != 5 || !reflect.DeepEqual(results, []testDoc{{ID: "3", Name: "three"}}) {
+		t.Errorf("unexpected page %d %v", total, results)
+	}
+	if len(findOpts) != 1 || *findOpts[0].Skip != 2 || *findOpts[0].Limit != 2 {
+		t.Errorf("expected skip 2 limit 2, got %+v", findOpts)
+	}
+
+	if _, err := c.FindPage(context.Background(), bson.D{}, 1, 2, &results, "-created", "name"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := bson.D{{Key: "created", Value: -1}, {Key: "name", Value: 1}, {Key: "_id", Value: 1}}
+	if len(findOpts) != 1 || !reflect.DeepEqual(findOpts[0].Sort, expected) {
+		t.Errorf("expected the sort fields then _id, got %+v", findOpts[0].Sort)
+	}
+	if _, err := c.FindPage(context.Background(), bson.D{}, 1, 2, &results, "-_id"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(findOpts[0].Sort, bson.D{{Key: "_id", Value: -1}}) {
+		t.Errorf("expected only the descending _id sort, got %+v", findOpts[0].Sort)
+	}
+}
+
+func TestSort(t *testing.T) {
+	for _, c := range []struct {
+		fields   []string
+		expected bson.D
+	}{
+		{[]string{"name"}, bson.D{{Key: "name", Value: 1}}},
+		{[]string{"+name"}, bson.D{{Key: "name", Value: 1}}},
+		{[]string{"-created"}, bson.D{{Key: "created", Value: -1}}},
+		{[]string{"-created", "name", "-score"}, bson.D{{Key: "created", Value: -1}, {Key: "name", Value: 1}, {Key: "score", Value: -1}}},
+		{nil, bson.D{}},
+	} {
+		if actual := Sort(c.fields...); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%v: expected %v, got %v", c.fields, c.expected, actual)
+		}
+	}
+}
+
+func TestProjection(t *testing.T) {
+	include := func(fields ...string) *options.FindOptions {
+		opts, err := Include(fields...)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return opts
+	}
+	for _, c := range []struct {
+		opts     *options.FindOptions
+		expected bson.D
+	}{
+		{include("name", "email"), bson.D{{Key: "name", Value: 1}, {Key: "email", Value: 1}}},
+		{include("name", "-_id"), bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 0}}},
+		{Exclude("password", "tokens"), bson.D{{Key: "password", Value: 0}, {Key: "tokens", Value: 0}}},
+		{Exclude("_id"), bson.D{{Key: "_id", Value: 0}}},
+	} {
+		if !reflect.DeepEqual(c.opts.Projection, c.expected) {
+			t.Errorf("expected %v, got %v", c.expected, c.opts.Projection)
+		}
+	}
+
+	opts, err := Include("name", "-email")
+	if opts != nil || err == nil || !strings.Contains(err.Error(), "can't exclude email") {
+		t.Errorf("expected an error for mixing included and excluded fields, got %v %v", opts, err)
+	}
+}
+
+func TestAll(t *testing.T) {
+	docs := []interface{}{
+		bson.D{{Key: "_id", Value: "1"}},
+		bson.D{{Key: "_id", Value: "2"}},
+		bson.D{{Key: "_id", Value: "3"}},
+	}
+
+	// the same calls a range loop makes
+	cur := NewMockCursor(docs...)
+	var all []string
+	cur.All(context.Background())(func(doc []byte, err error) bool {
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		all = append(all, string(doc))
+		return true
+	})
+	if !reflect.DeepEqual(all, []string{`{"_id":"1"}`, `{"_id":"2"}`, `{"_id":"3"}`}) {
+		t.Errorf("unexpected documents %v", all)
+	}
+	if !cur.closed {
+		t.Error("expected the cursor to be closed")
+	}
+
+	// break after the first document
+	cur = NewMockCursor(docs...)
+	calls := 0
+	cur.All(context.Background())(func(doc []byte, err error) bool {
+		calls++
+		return false
+	})
+	if calls != 1 || !cur.closed {
+		t.Errorf("expected 1 call and a closed cursor, got %d calls, closed %v", calls, cur.closed)
+	}
+
+	// the cursor's error ends the iteration
+	cur = NewMockCursor()
+	cur.WithErr(errors.New("cursor killed"))
+	var iterErr error
+	cur.All(context.Background())(func(doc []byte, err error) bool {
+		iterErr = err
+		return true
+	})
+	if iterErr == nil || errors.Cause(iterErr).Error() != "cursor killed" || !cur.closed {
+		t.Errorf("expected the cursor's error and a closed cursor, got %v, closed %v", iterErr, cur.closed)
+	}
+}
+
+func TestAggregateOpts(t *testing.T) {
+	var aggregateOpts []*options.AggregateOptions
+	c := Collection{c: &fakeCollection{aggregate: func(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error) {
+		aggregateOpts = opts
+		return NewMockCursor(), nil
+	}}}
+	var results []testDoc
+	opts := AggregateOpts{AllowDiskUse: true, BatchSize: 100, Comment: "daily rollup", MaxTime: time.Minute}
+	if err := c.AggregateAll(context.Background(), bson.A{}, &results, opts.Options()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(aggregateOpts) != 1 {
+		t.Fatalf("expected the options to reach Aggregate, got %v", aggregateOpts)
+	}
+	actual := aggregateOpts[0]
+	if !*actual.AllowDiskUse || *actual.BatchSize != 100 || *actual.Comment != "daily rollup" || *actual.MaxTime != time.Minute {
+		t.Errorf("unexpected options %+v", actual)
+	}
+
+	if empty := (AggregateOpts{}).Options(); empty.AllowDiskUse != nil || empty.BatchSize != nil || empty.Comment != nil || empty.MaxTime != nil {
+		t.Errorf("expected zero fields to be left unset, got %+v", empty)
+	}
+}
+
+// fakeSession is only ever stored in a context, the embedded nil Session
+// satisfies the interface's unexported method
+type fakeSession struct {
+	mongodb.Session
+}
+
+func TestWithRetry(t *testing.T) {
+	network := mongodb.CommandError{Code: 6, Message: "host unreachable", Labels: []string{"NetworkError"}}
+	calls := 0
+	c := Collection{c: &fakeCollection{
+		find: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+			return NewMockCursor(), nil
+		},
+		count: func(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+			calls++
+			if calls < 3 {
+				return 0, network
+			}
+			return 7, nil
+		},
+	}}.WithRetry(3, time.Millisecond)
+	var results []testDoc
+	total, err := c.FindPage(context.Background(), bson.D{}, 1, 10, &results)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if total != 7 || calls != 3 {
+		t.Errorf("expected 7 after 3 calls, got %d after %d", total, calls)
+	}
+
+	retryableWrite := mongodb.CommandError{Code: 91, Message: "shutting down", Labels: []string{"RetryableWriteError"}}
+	transaction := mongodb.CommandError{Code: 112, Message: "write conflict", Labels: []string{"TransientTransactionError"}}
+	permanent := mongodb.CommandError{Code: 2, Message: "bad value"}
+	session := mongodb.NewSessionContext(context.Background(), fakeSession{})
+	cases := []struct {
+		name      string
+		ctx       context.Context
+		retryable func(error) bool
+		err       error
+		calls     int
+	}{
+		{"a read after a network error", context.Background(), isRetryableRead, network, 3},
+		{"a read after a permanent error", context.Background(), isRetryableRead, permanent, 1},
+		{"a write labeled RetryableWriteError", context.Background(), isRetryableWrite, retryableWrite, 3},
+		{"a write after an unlabeled network error", context.Background(), isRetryableWrite, network, 1},
+		{"a read after a TransientTransactionError", context.Background(), isRetryableRead, transaction, 1},
+		{"a write after a TransientTransactionError", context.Background(), isRetryableWrite, transaction, 1},
+		{"a read in a session", session, isRetryableRead, network, 1},
+		{"a write in a session", session, isRetryableWrite, retryableWrite, 1},
+	}
+	for _, tc := range cases {
+		calls = 0
+		err = c.retry(tc.ctx, "test", nil, tc.retryable, func(ctx context.Context) error {
+			calls++
+			return errors.WithStack(tc.err)
+		})
+		if _, ok := errors.Cause(err).(mongodb.CommandError); !ok || calls != tc.calls {
+			t.Errorf("%s: expected the error after %d calls, got %v after %d", tc.name, tc.calls, err, calls)
+		}
+	}
+}
+
+func TestWithObserver(t *testing.T) {
+	type observed struct {
+		op  string
+		err error
+	}
+	var calls []observed
+	findErr := errors.New("find failed")
+	c := Collection{c: &fakeCollection{
+		find: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+			return nil, findErr
+		},
+		insert: func(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongodb.InsertOneResult, error) {
+			return &mongodb.InsertOneResult{InsertedID: objectId}, nil
+		},
+	}}
+	// no observer, nothing to call
+	if _, err := c.InsertOne(context.Background(), testDoc{Name: "one"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	c = c.WithObserver(func(op string, d time.Duration, err error) {
+		if d < 0 {
+			t.Errorf("expected a positive duration for %s, got %v", op, d)
+		}
+		calls = append(calls, observed{op: op, err: err})
+	})
+	if _, err := c.Find(context.Background(), bson.D{}); errors.Cause(err) != findErr {
+		t.Errorf("expected the find error, got %v", err)
+	}
+	if _, err := c.InsertOne(context.Background(), testDoc{Name: "two"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := []observed{{op: "Find", err: findErr}, {op: "InsertOne"}}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+}
+
+func TestWithTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	transient := mongodb.CommandError{Code: 6, Message: "host unreachable", Labels: []string{"NetworkError"}}
+	attempts := 0
+	c := Collection{c: &fakeCollection{
+		find: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+			if !trace.SpanContextFromContext(ctx).IsValid() {
+				t.Error("expected Find to run with the span's context")
+			}
+			attempts++
+			return nil, transient
+		},
+		insert: func(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongodb.InsertOneResult, error) {
+			return &mongodb.InsertOneResult{InsertedID: objectId}, nil
+		},
+	}}.WithRetry(2, time.Millisecond).WithTracing(tp)
+
+	if _, err := c.Find(context.Background(), bson.D{{Key: "name", Value: "one"}}); err == nil {
+		t.Error("expected the find error")
+	}
+	if _, err := c.InsertOne(context.Background(), testDoc{Name: "one"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	spans := exporter.GetSpans()
+	if attempts != 2 || len(spans) != 2 {
+		t.Fatalf("expected 1 ended span per operation across 2 attempts, got %d spans after %d attempts", len(spans), attempts)
+	}
+	find, insert := spans[0], spans[1]
+	if find.Name != "mongo.Find" || find.Status.Code != codes.Error || find.Status.Description != transient.Message || len(find.Events) != 1 {
+		t.Errorf("expected the find error on the mongo.Find span, got %q %+v %d events", find.Name, find.Status, len(find.Events))
+	}
+	if insert.Name != "mongo.InsertOne" || insert.Status.Code == codes.Error || len(insert.Events) != 0 {
+		t.Errorf("expected no error on the mongo.InsertOne span, got %q %+v %d events", insert.Name, insert.Status, len(insert.Events))
+	}
+	for _, span := range spans {
+		attrs := attribute.NewSet(span.Attributes...)
+		if v, ok := attrs.Value("db.mongodb.collection"); !ok || v.AsString() != "fake" {
+			t.Errorf("%s: expected the collection name, got %v", span.Name, v.Emit())
+		}
+		if attrs.HasValue("db.mongodb.filter") {
+			t.Errorf("%s: expected no filter unless WithTracedFilters is called", span.Name)
+		}
+	}
+
+	exporter.Reset()
+	if _, err := c.WithTracedFilters().Find(context.Background(), bson.D{{Key: "name", Value: "one"}}); err == nil {
+		t.Error("expected the find error")
+	}
+	spans = exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	attrs := attribute.NewSet(spans[0].Attributes...)
+	filter, _ := attrs.Value("db.mongodb.filter")
+	if filter.AsString() != `{"name":"one"}` {
+		t.Errorf("expected the filter, got %q", filter.AsString())
+	}
+}
+
+func TestInsertOneID(t *testing.T) {
+	var insertedID interface{} = objectId
+	c := Collection{c: &fakeCollection{insert: func(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongodb.InsertOneResult, error) {
+		return &mongodb.InsertOneResult{InsertedID: insertedID}, nil
+	}}}
+	id, err := c.InsertOneID(context.Background(), testDoc{Name: "one"})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if id != objectId {
+		t.Errorf("expected %v, got %v", objectId, id)
+	}
+	if hex, err := c.InsertOne(context.Background(), testDoc{Name: "one"}); err != nil || hex != objectId.Hex() {
+		t.Errorf("expected %s, got %s %v", objectId.Hex(), hex, err)
+	}
+
+	insertedID = "custom-id"
+	if id, err := c.InsertOneID(context.Background(), testDoc{ID: "custom-id"}); err == nil || !id.IsZero() {
+		t.Errorf("expected an error for a string _id, got %v %v", id, err)
+	}
+}
+
+func TestDecodeAllCancelled(t *testing.T) {
+	docs := []interface{}{
+		bson.D{{Key: "_id", Value: "1"}},
+		bson.D{{Key: "_id", Value: "2"}},
+		bson.D{{Key: "_id", Value: "3"}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cur := NewMockCursor(docs...)
+	var results []testDoc
+	err := decodeAll(ctx, cancelAfter{MockCursor: cur, cancel: cancel, n: 1}, &results)
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if cur.idx != 1 || !cur.closed || results != nil {
+		t.Errorf("expected the scan to stop at the second document and close the cursor, got %d, closed %v, %v", cur.idx, cur.closed, results)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	cur = NewMockCursor(docs...)
+	var all []string
+	var iterErr error
+	iterate(ctx, cancelAfter{MockCursor: cur, cancel: cancel, n: 1})(func(doc []byte, err error) bool {
+		if err != nil {
+			iterErr = err
+			return false
+		}
+		all = append(all, string(doc))
+		return true
+	})
+	if errors.Cause(iterErr) != context.Canceled || len(all) != 1 || !cur.closed {
+		t.Errorf("expected 1 document then context.Canceled, got %v %v, closed %v", all, iterErr, cur.closed)
+	}
+}
+
+// cancelAfter cancels its context once n documents have been read
+type cancelAfter struct {
+	*MockCursor
+	cancel func()
+	n      int
+}
+
+func (c cancelAfter) Current() []byte {
+	defer c.check()
+	return c.MockCursor.Current()
+}
+
+func (c cancelAfter) Decode(val interface{}) error {
+	defer c.check()
+	return c.MockCursor.Decode(val)
+}
+
+func (c cancelAfter) check() {
+	if c.idx+1 >= c.n {
+		c.cancel()
+	}
+}
+
+func TestAggregateMaps(t *testing.T) {
+	c := Collection{c: &fakeCollection{aggregate: func(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error) {
+		return NewMockCursor(
+			bson.D{{Key: "_id", Value: objectId}, {Key: "count", Value: int32(3)}, {Key: "total", Value: 12.5}, {Key: "names", Value: bson.A{"a", "b"}}},
+			bson.D{{Key: "_id", Value: nil}, {Key: "count", Value: int64(1)}, {Key: "total", Value: 0.0}, {Key: "names", Value: bson.A{}}},
+		), nil
+	}}}
+	pipeline := bson.A{bson.D{{Key: "$group", Value: bson.D{
+		{Key: "_id", Value: "$owner"},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		{Key: "total", Value: bson.D{{Key: "$sum", Value: "$amount"}}},
+		{Key: "names", Value: bson.D{{Key: "$push", Value: "$name"}}},
+	}}}}
+	results, err := c.AggregateMaps(context.Background(), pipeline)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := []map[string]interface{}{
+		{"_id": objectId.Hex(), "count": float64(3), "total": 12.5, "names": []interface{}{"a", "b"}},
+		{"_id": nil, "count": float64(1), "total": float64(0), "names": []interface{}{}},
+	}
+	if !reflect.DeepEqual(expected, results) {
+		t.Errorf("expected: %v\nactual:   %v", expected, results)
+	}
+}
+
+func TestAggregateJoin(t *testing.T) {
+	var pipelines []interface{}
+	c := Collection{c: &fakeCollection{aggregate: func(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error) {
+		pipelines = append(pipelines, pipeline)
+		return NewMockCursor(bson.D{
+			{Key: "_id", Value: "1"},
+			{Key: "customer", Value: bson.A{bson.D{{Key: "_id", Value: "c1"}, {Key: "name", Value: "one"}}}},
+		}), nil
+	}}}
+	lookup := Lookup{From: "customers", LocalField: "customerId", ForeignField: "_id", As: "customer"}
+	var results []struct {
+		ID       string    `json:"_id"`
+		Customer []testDoc `json:"customer"`
+	}
+	filter := bson.D{{Key: "status", Value: "open"}}
+	if err := c.AggregateJoin(context.Background(), filter, lookup, &results); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(results) != 1 || !reflect.DeepEqual(results[0].Customer, []testDoc{{ID: "c1", Name: "one"}}) {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if err := c.AggregateJoin(context.Background(), nil, lookup, &results); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	stage := bson.D{{Key: "$lookup", Value: bson.D{
+		{Key: "from", Value: "customers"},
+		{Key: "localField", Value: "customerId"},
+		{Key: "foreignField", Value: "_id"},
+		{Key: "as", Value: "customer"},
+	}}}
+	expected := []interface{}{
+		mongodb.Pipeline{bson.D{{Key: "$match", Value: filter}}, stage},
+		mongodb.Pipeline{stage},
+	}
+	if !reflect.DeepEqual(pipelines, expected) {
+		t.Errorf("expected: %v\nactual:   %v", expected, pipelines)
+	}
+}
+
+func TestDeadlineMaxTime(t *testing.T) {
+	var findOpts []*options.FindOptions
+	var aggregateOpts []*options.AggregateOptions
+	c := Collection{c: &fakeCollection{
+		find: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+			findOpts = opts
+			return nil, errors.New("no server")
+		},
+		aggregate: func(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (Cursor, error) {
+			aggregateOpts = opts
+			return nil, errors.New("no server")
+		},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, _ = c.Find(ctx, bson.D{})
+	if len(findOpts) != 1 || findOpts[0].MaxTime == nil || *findOpts[0].MaxTime <= 59*time.Second || *findOpts[0].MaxTime > time.Minute {
+		t.Errorf("expected MaxTime from the deadline, got %+v", findOpts)
+	}
+	_, _ = c.Aggregate(ctx, mongodb.Pipeline{})
+	if len(aggregateOpts) != 1 || aggregateOpts[0].MaxTime == nil || *aggregateOpts[0].MaxTime <= 59*time.Second || *aggregateOpts[0].MaxTime > time.Minute {
+		t.Errorf("expected MaxTime from the deadline, got %+v", aggregateOpts)
+	}
+
+	// a MaxTime that's set is kept
+	_, _ = c.Aggregate(ctx, mongodb.Pipeline{}, options.Aggregate().SetMaxTime(time.Second))
+	if len(aggregateOpts) != 1 || *aggregateOpts[0].MaxTime != time.Second {
+		t.Errorf("expected the MaxTime option to be kept, got %+v", aggregateOpts)
+	}
+	// as is the lack of one without a deadline
+	_, _ = c.Find(context.Background(), bson.D{}, options.Find().SetLimit(1))
+	if len(findOpts) != 1 || findOpts[0].MaxTime != nil {
+		t.Errorf("expected no MaxTime without a deadline, got %+v", findOpts)
+	}
+	// WithTimeout gives operations a deadline too
+	_, _ = c.WithTimeout(time.Second).Find(context.Background(), bson.D{})
+	if len(findOpts) != 1 || findOpts[0].MaxTime == nil || *findOpts[0].MaxTime > time.Second {
+		t.Errorf("expected MaxTime from the collection's timeout, got %+v", findOpts)
+	}
+}
+
+func TestExists(t *testing.T) {
+	var matches int64
+	var countOpts []*options.CountOptions
+	c := Collection{c: &fakeCollection{count: func(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+		countOpts = opts
+		return matches, nil
+	}}}
+	filter := bson.D{{Key: "email", Value: "a@b.c"}}
+
+	matches = 1
+	exists, err := c.Exists(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !exists {
+		t.Error("expected a match")
+	}
+	if len(countOpts) != 1 || countOpts[0].Limit == nil || *countOpts[0].Limit != 1 {
+		t.Errorf("expected a limit of 1, got %+v", countOpts)
+	}
+
+	matches = 0
+	if exists, err := c.Exists(context.Background(), filter); err != nil || exists {
+		t.Errorf("expected no match, got %v %v", exists, err)
+	}
+}
+
+func TestFindIDs(t *testing.T) {
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+	var findOpts []*options.FindOptions
+	fake := &fakeCollection{find: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+		findOpts = opts
+		return NewMockCursor(bson.D{{Key: "_id", Value: first}}, bson.D{{Key: "_id", Value: second}}), nil
+	}}
+	c := Collection{c: fake}
+	ids, err := c.FindIDs(context.Background(), bson.D{}, options.Find().SetProjection(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(ids, []string{first.Hex(), second.Hex()}) {
+		t.Errorf("expected %v, got %v", []string{first.Hex(), second.Hex()}, ids)
+	}
+	if len(findOpts) != 2 || !reflect.DeepEqual(findOpts[1].Projection, bson.D{{Key: "_id", Value: 1}}) {
+		t.Errorf("expected the _id projection to be applied last, got %+v", findOpts)
+	}
+
+	callerOpts := make([]*options.FindOptions, 1, 2)
+	callerOpts[0] = options.Find()
+	if _, err := c.FindIDs(context.Background(), bson.D{}, callerOpts...); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if spare := callerOpts[:2][1]; spare != nil {
+		t.Errorf("expected the caller's slice not to be appended to, got %+v", spare)
+	}
+
+	fake.find = func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+		return NewMockCursor(), nil
+	}
+	if ids, err := c.FindIDs(context.Background(), bson.D{}); err != nil || ids == nil || len(ids) != 0 {
+		t.Errorf("expected an empty slice, got %v %v", ids, err)
+	}
+	fake.find = func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+		return NewMockCursor(
+			bson.D{{Key: "_id", Value: objectId}},
+			bson.D{{Key: "_id", Value: int32(7)}},
+			bson.D{{Key: "_id", Value: int64(1) << 40}},
+		), nil
+	}
+	ids, err = c.FindIDs(context.Background(), bson.D{})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if expected := []string{objectId.Hex(), "7", "1099511627776"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, got %v", expected, ids)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	dropErr := errors.New("drop failed")
+	drops := 0
+	c := Collection{c: &fakeCollection{drop: func(ctx context.Context) error {
+		drops++
+		return dropErr
+	}}}
+	if err := c.Drop(context.Background()); errors.Cause(err) != dropErr {
+		t.Errorf("expected %v, got %v", dropErr, err)
+	}
+	if drops != 1 {
+		t.Errorf("expected 1 drop, got %d", drops)
+	}
+}
+
+func TestRename(t *testing.T) {
+	var commands []interface{}
+	var adminErr error
+	c := Collection{c: &fakeCollection{admin: func(ctx context.Context, cmd interface{}) error {
+		commands = append(commands, cmd)
+		return adminErr
+	}}}
+	if err := c.Rename(context.Background(), "renamed"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := []interface{}{bson.D{
+		{Key: "renameCollection", Value: "test.fake"},
+		{Key: "to", Value: "test.renamed"},
+	}}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected: %v\nactual:   %v", expected, commands)
+	}
+
+	adminErr = errors.New("target namespace exists")
+	if err := c.Rename(context.Background(), "renamed"); errors.Cause(err) != adminErr {
+		t.Errorf("expected %v, got %v", adminErr, err)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	var result *mongodb.UpdateResult
+	var updateOpts []*options.UpdateOptions
+	c := Collection{c: &fakeCollection{update: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongodb.UpdateResult, error) {
+		updateOpts = opts
+		return result, nil
+	}}}
+	filter := bson.D{{Key: "email", Value: "a@b.c"}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "a"}}}}
+
+	// no match, so a document is inserted
+	result = &mongodb.UpdateResult{UpsertedCount: 1, UpsertedID: objectId}
+	id, created, err := c.Upsert(context.Background(), filter, update)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !created || id != objectId.Hex() {
+		t.Errorf("expected a created document %s, got %q %v", objectId.Hex(), id, created)
+	}
+	if len(updateOpts) != 1 || updateOpts[0].Upsert == nil || !*updateOpts[0].Upsert {
+		t.Errorf("expected upsert to be set, got %+v", updateOpts)
+	}
+
+	// a match, so it's updated
+	result = &mongodb.UpdateResult{MatchedCount: 1, ModifiedCount: 1}
+	id, created, err = c.Upsert(context.Background(), filter, update)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if created || id != "" {
+		t.Errorf("expected an update, got %q %v", id, created)
+	}
+}
+
+func TestWithJSON(t *testing.T) {
+	strict := Collection{}.WithJSON(jsoniter.Config{DisallowUnknownFields: true}.Froze())
+	doc, err := bson.Marshal(bson.D{{Key: "_id", Value: "1"}, {Key: "name", Value: "one"}, {Key: "extra", Value: true}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var result testDoc
+	lenient := &decoder{result: mockSingleResult{doc: doc}}
+	if err := lenient.Decode(&result); err != nil || result.Name != "one" {
+		t.Errorf("expected the default config to ignore unknown fields, got %v %v", result, err)
+	}
+	d := &decoder{result: mockSingleResult{doc: doc}, api: strict.api}
+	if err := d.Decode(&result); err == nil {
+		t.Error("expected the injected config to reject the unknown field")
+	}
+
+	cur := &cursor{Cursor: mongodb.Cursor{Current: doc}, api: strict.api}
+	if err := cur.Decode(&result); err == nil {
+		t.Error("expected the cursor to use the injected config")
+	}
+
+	strict.c = &fakeCollection{find: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+		return &cursor{Cursor: mongodb.Cursor{Current: doc}}, nil
+	}}
+	found, err := strict.Find(context.Background(), bson.D{})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := found.Decode(&result); err == nil {
+		t.Error("expected Find's cursor to use the injected config")
+	}
+}
+
+func TestWithWriteConcernAndReadPreference(t *testing.T) {
+	var applied []*options.CollectionOptions
+	cloned := &fakeCollection{}
+	original := &fakeCollection{clone: func(opts ...*options.CollectionOptions) driverCollection {
+		applied = append(applied, opts...)
+		return cloned
+	}}
+	c := Collection{c: original}.WithTimeout(time.Second)
+
+	wc := writeconcern.New(writeconcern.WMajority())
+	majority := c.WithWriteConcern(wc)
+	if len(applied) != 1 || applied[0].WriteConcern != wc {
+		t.Fatalf("expected the write concern to be applied to the clone, got %v", applied)
+	}
+	if majority.c != cloned || majority.timeout != time.Second {
+		t.Error("expected a copy wrapping the cloned collection with the same settings")
+	}
+	if c.c != original {
+		t.Error("expected the original collection to be unchanged")
+	}
+
+	rp := readpref.SecondaryPreferred()
+	secondaries := c.WithReadPreference(rp)
+	if len(applied) != 2 || applied[1].ReadPreference != rp || applied[1].WriteConcern != nil {
+		t.Fatalf("expected only the read preference to be applied to the clone, got %v", applied)
+	}
+	if secondaries.c != cloned {
+		t.Error("expected a copy wrapping the cloned collection")
+	}
+}
+
+func TestCurrentJSON(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{{Key: "_id", Value: objectId}, {Key: "name", Value: "one"}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	cur := &cursor{Cursor: mongodb.Cursor{Current: doc}}
+	response, err := json.Marshal(struct {
+		Data jsondec.RawMessage `json:"data"`
+	}{Data: cur.CurrentJSON()})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if expected := `{"data":{"_id":"0123456789abcdef01234567","name":"one"}}`; string(response) != expected {
+		t.Errorf("expected: %s\nactual:   %s", expected, response)
+	}
+}
+
+func TestDecodeBytesRaw(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{{Key: "_id", Value: objectId}, {Key: "amount", Value: int64(5)}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	d := &decoder{result: mockSingleResult{doc: raw}}
+	actual, err := d.DecodeBytesRaw()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(actual, raw) {
+		t.Errorf("expected the unconverted bson %v, got %v", raw, actual)
+	}
+	// converting afterwards still works
+	if jsn, err := d.DecodeBytes(); err != nil || string(jsn) != `{"_id":"0123456789abcdef01234567","amount":5}` {
+		t.Errorf("unexpected json %s %v", jsn, err)
+	}
+
+	notFound := &decoder{result: mockSingleResult{err: mongodb.ErrNoDocuments}}
+	if _, err := notFound.DecodeBytesRaw(); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBulkUpsert(t *testing.T) {
+	var models []mongodb.WriteModel
+	c := Collection{c: &fakeCollection{bulkWrite: func(ctx context.Context, m []mongodb.WriteModel, opts ...*options.BulkWriteOptions) (*mongodb.BulkWriteResult, error) {
+		models = m
+		// the first document was new, the second matched
+		return &mongodb.BulkWriteResult{
+			MatchedCount:  1,
+			ModifiedCount: 1,
+			UpsertedCount: 1,
+			UpsertedIDs:   map[int64]interface{}{0: objectId},
+		}, nil
+	}}}
+	documents := []interface{}{
+		bson.D{{Key: "externalId", Value: "a"}, {Key: "name", Value: "one"}},
+		bson.D{{Key: "_id", Value: objectId}, {Key: "externalId", Value: "b"}, {Key: "name", Value: "two"}},
+	}
+	result, err := c.BulkUpsert(context.Background(), "externalId", documents)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := BulkResult{MatchedCount: 1, ModifiedCount: 1, UpsertedCount: 1, UpsertedIDs: map[int64]string{0: objectId.Hex()}}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected: %+v\nactual:   %+v", expected, result)
+	}
+
+	if len(models) != 2 {
+		t.Fatalf("expected 2 models, got %d", len(models))
+	}
+	first := models[0].(*mongodb.UpdateOneModel)
+	if !reflect.DeepEqual(first.Filter, bson.D{{Key: "externalId", Value: "a"}}) || first.Upsert == nil || !*first.Upsert {
+		t.Errorf("unexpected model %+v", first)
+	}
+	if expected := (bson.D{{Key: "$set", Value: bson.M{"externalId": "a", "name": "one"}}}); !reflect.DeepEqual(first.Update, expected) {
+		t.Errorf("expected: %v\nactual:   %v", expected, first.Update)
+	}
+	second := models[1].(*mongodb.UpdateOneModel)
+	expectedUpdate := bson.D{
+		{Key: "$setOnInsert", Value: bson.M{"_id": objectId}},
+		{Key: "$set", Value: bson.M{"externalId": "b", "name": "two"}},
+	}
+	if !reflect.DeepEqual(second.Update, expectedUpdate) {
+		t.Errorf("expected: %v\nactual:   %v", expectedUpdate, second.Update)
+	}
+
+	if _, err := c.BulkUpsert(context.Background(), "sku", documents); err == nil {
+		t.Error("expected an error for a document without the key")
+	}
+
+	type tagged struct {
+		ExternalID string `bsoncv:"externalId"`
+		OwnerID    string `bsoncv:"ownerId,$oid"`
+	}
+	if _, err := c.BulkUpsert(context.Background(), "externalId", []interface{}{&tagged{ExternalID: "c", OwnerID: objectId.Hex()}}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	update := models[0].(*mongodb.UpdateOneModel).Update
+	if expected := (bson.D{{Key: "$set", Value: bson.M{"externalId": "c", "ownerId": objectId}}}); !reflect.DeepEqual(update, expected) {
+		t.Errorf("expected the bsoncv tags to be applied: %v\nactual:   %v", expected, update)
+	}
+}
+
+func TestBulkUpsertEmpty(t *testing.T) {
+	c := Collection{c: &fakeCollection{bulkWrite: func(ctx context.Context, m []mongodb.WriteModel, opts ...*options.BulkWriteOptions) (*mongodb.BulkWriteResult, error) {
+		t.Error("expected no BulkWrite without documents")
+		return nil, mongodb.ErrEmptySlice
+	}}}
+	result, err := c.BulkUpsert(context.Background(), "externalId", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(result, BulkResult{}) {
+		t.Errorf("expected an empty result, got %+v", result)
+	}
+}
+
+func TestWriteJSONArray(t *testing.T) {
+	cases := []struct {
+		docs     []interface{}
+		expected string
+	}{
+		{nil, `[]`},
+		{[]interface{}{bson.D{{Key: "_id", Value: "1"}}}, `[{"_id":"1"}]`},
+		{[]interface{}{
+			bson.D{{Key: "_id", Value: "1"}},
+			bson.D{{Key: "_id", Value: objectId}, {Key: "tags", Value: bson.A{"a", "b"}}},
+			bson.D{{Key: "_id", Value: "3"}},
+		}, `[{"_id":"1"},{"_id":"0123456789abcdef01234567","tags":["a","b"]},{"_id":"3"}]`},
+	}
+	for _, c := range cases {
+		cur := NewMockCursor(c.docs...)
+		var buf bytes.Buffer
+		if err := cur.WriteJSONArray(context.Background(), &buf); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if buf.String() != c.expected {
+			t.Errorf("expected: %s\nactual:   %s", c.expected, buf.String())
+		}
+		if !cur.closed {
+			t.Errorf("expected the cursor to be closed after %d documents", len(c.docs))
+		}
+	}
+
+	cur := NewMockCursor()
+	cur.WithErr(errors.New("cursor killed"))
+	if err := cur.WriteJSONArray(context.Background(), ioutil.Discard); err == nil || errors.Cause(err).Error() != "cursor killed" || !cur.closed {
+		t.Errorf("expected the cursor's error and a closed cursor, got %v, closed %v", err, cur.closed)
+	}
+}
+
+// ObjectIDs are written to json as hex strings, which primitive.ObjectID's
+// UnmarshalJSON accepts, so structs can use native ids
+func TestDecodeObjectID(t *testing.T) {
+	type withObjectIDs struct {
+		ID       primitive.ObjectID   `json:"_id"`
+		Owner    *primitive.ObjectID  `json:"owner"`
+		Related  []primitive.ObjectID `json:"related"`
+		Optional primitive.ObjectID   `json:"optional"`
+	}
+	id, owner, related := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	doc, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: id},
+		{Key: "owner", Value: owner},
+		{Key: "related", Value: bson.A{related}},
+		{Key: "optional", Value: nil},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var result withObjectIDs
+	d := &decoder{result: mockSingleResult{doc: doc}}
+	if err := d.Decode(&result); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := withObjectIDs{ID: id, Owner: &owner, Related: []primitive.ObjectID{related}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	var results []withObjectIDs
+	if err := NewMockCursor(bson.D{{Key: "_id", Value: id}}).DecodeAll(context.Background(), &results); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(results) != 1 || results[0].ID != id {
+		t.Errorf("expected the cursor to decode the ObjectID, got %+v", results)
+	}
+}
+
+// Decode reads documents through json, there's no reverse of StructToMap. A
+// bson null leaves a pointer field nil, even one that was set, and a value
+// field at its zero value.
+func TestDecodeNull(t *testing.T) {
+	type optional struct {
+		ID       string  `json:"_id"`
+		Nickname *string `json:"nickname"`
+		Age      int     `json:"age"`
+		Inner    *struct {
+			Name string `json:"name"`
+		} `json:"inner"`
+	}
+	doc, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: "1"},
+		{Key: "nickname", Value: nil},
+		{Key: "age", Value: nil},
+		{Key: "inner", Value: nil},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	nickname := "stale"
+	result := optional{Nickname: &nickname}
+	d := &decoder{result: mockSingleResult{doc: doc}}
+	if err := d.Decode(&result); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if result.ID != "1" || result.Nickname != nil || result.Age != 0 || result.Inner != nil {
+		t.Errorf("expected nulls to decode to nil pointers and zero values, got %+v", result)
+	}
+}